@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/service"
+)
+
+// handleUserAttributes serves /users/{id}/attributes (list, set)
+func handleUserAttributes(w http.ResponseWriter, r *http.Request, repo repository.AttributeRepository) {
+	userID := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		attrs, err := repo.List(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, http.StatusOK, attrs)
+
+	case http.MethodPut:
+		var req struct {
+			Attributes []domain.UserAttribute `json:"attributes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for _, a := range req.Attributes {
+			if err := a.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if before, err := repo.List(r.Context(), userID); err == nil {
+			auditBefore(r, before)
+		}
+
+		// Evaluation walks user_metrics, so make sure the user is in it
+		if err := metricsRepo.EnsureUser(r.Context(), userID); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := repo.Set(r.Context(), userID, req.Attributes); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// Re-evaluate right away so targeting reflects the new attributes
+		if err := service.EvaluateSpecificUser(r.Context(), db, rdb, userID); err != nil {
+			log.Printf("Error in evaluation: %v", err)
+		}
+
+		attrs, err := repo.List(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		auditAfter(r, attrs)
+		log.Printf("✅ Set %d attributes for %s", len(req.Attributes), userID)
+		writeJSON(w, http.StatusOK, attrs)
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// handleUserAttribute serves DELETE /users/{id}/attributes/{key}
+func handleUserAttribute(w http.ResponseWriter, r *http.Request, repo repository.AttributeRepository) {
+	userID := r.PathValue("id")
+	if before, err := repo.List(r.Context(), userID); err == nil {
+		auditBefore(r, before)
+	}
+	if err := repo.Delete(r.Context(), userID, r.PathValue("key")); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	if err := service.EvaluateSpecificUser(r.Context(), db, rdb, userID); err != nil {
+		log.Printf("Error in evaluation: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/repository"
+)
+
+// readOnlyPosts are POST routes that change nothing and are not audited
+var readOnlyPosts = map[string]bool{
+	"POST /rules/compile":    true,
+	"POST /segments/dry-run": true,
+}
+
+// auditRecord collects what a handler knows about the resource it changed
+type auditRecord struct {
+	resourceID string
+	before     json.RawMessage
+	after      json.RawMessage
+}
+
+type auditKey struct{}
+
+// auditBefore records the resource as it was before the handler changed it.
+// v is encoded immediately, so the handler may go on to modify it.
+func auditBefore(r *http.Request, v interface{}) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.before, _ = json.Marshal(v)
+	}
+}
+
+// auditAfter records the resource as the handler left it
+func auditAfter(r *http.Request, v interface{}) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.after, _ = json.Marshal(v)
+	}
+}
+
+// auditResource names the resource when the route does not, e.g. an ID
+// that was only just created or that came in the request body
+func auditResource(r *http.Request, id string) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.resourceID = id
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withAudit appends an audit log entry for every mutating request, whether
+// it succeeded or not. Every request gets an ID, taken from X-Request-ID
+// when the caller sends one and echoed back in the response.
+func withAudit(next http.Handler, repo repository.AuditRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &auditRecord{}
+		req := r.WithContext(context.WithValue(r.Context(), auditKey{}, rec))
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+
+		// The mux fills in the matched pattern while routing
+		action := req.Pattern
+		if action == "" || readOnlyPosts[action] {
+			return
+		}
+		if !strings.HasPrefix(action, r.Method+" ") {
+			action = r.Method + " " + action
+		}
+
+		if rec.resourceID == "" {
+			rec.resourceID = resourceID(req)
+		}
+		entry := &domain.AuditEntry{
+			Actor:        actor(r),
+			Action:       action,
+			ResourceType: resourceType(r.URL.Path),
+			ResourceID:   rec.resourceID,
+			RequestID:    requestID,
+			Status:       sw.status,
+			Before:       rec.before,
+			After:        rec.after,
+		}
+		// Record the entry even if the client has gone away
+		if err := repo.Append(context.WithoutCancel(r.Context()), entry); err != nil {
+			log.Printf("❌ Failed to write audit entry for %s (request %s): %v", action, requestID, err)
+		}
+	})
+}
+
+// resourceType is the first path element, e.g. "segments"
+func resourceType(path string) string {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return first
+}
+
+// resourceID is the route's {id} and {key}, or the userId query parameter
+func resourceID(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		if key := r.PathValue("key"); key != "" {
+			return id + "/" + key
+		}
+		return id
+	}
+	if key := r.PathValue("key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("userId")
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleAudit serves GET /audit with optional filters actor, action,
+// resource_type, resource_id, request_id, since and until (RFC3339), and
+// keyset pagination through limit and cursor
+func handleAudit(w http.ResponseWriter, r *http.Request, repo repository.AuditRepository) {
+	q := r.URL.Query()
+	f := repository.AuditFilter{
+		Actor:        q.Get("actor"),
+		Action:       q.Get("action"),
+		ResourceType: q.Get("resource_type"),
+		ResourceID:   q.Get("resource_id"),
+		RequestID:    q.Get("request_id"),
+		Limit:        50,
+	}
+
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "until must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 || f.Limit > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("cursor"); s != "" {
+		if f.BeforeID, err = strconv.ParseInt(s, 10, 64); err != nil || f.BeforeID < 1 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := repo.List(r.Context(), f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// A full page may have more behind it
+	var next interface{}
+	if len(entries) == f.Limit {
+		next = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries":     entries,
+		"next_cursor": next,
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/service"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeAuditRepo keeps appended entries in memory and returns page from List
+type fakeAuditRepo struct {
+	entries []domain.AuditEntry
+	filter  repository.AuditFilter
+	page    []domain.AuditEntry
+}
+
+func (f *fakeAuditRepo) Append(ctx context.Context, e *domain.AuditEntry) error {
+	e.ID = int64(len(f.entries) + 1)
+	f.entries = append(f.entries, *e)
+	return nil
+}
+
+func (f *fakeAuditRepo) List(ctx context.Context, filter repository.AuditFilter) ([]domain.AuditEntry, error) {
+	f.filter = filter
+	return f.page, nil
+}
+
+type fakeStrategyRepo map[string]domain.MergeStrategy
+
+func (f fakeStrategyRepo) List(ctx context.Context) (map[string]domain.MergeStrategy, error) {
+	return f, nil
+}
+
+func (f fakeStrategyRepo) Set(ctx context.Context, key string, s domain.MergeStrategy) error {
+	f[key] = s
+	return nil
+}
+
+func (f fakeStrategyRepo) Delete(ctx context.Context, key string) error {
+	if _, ok := f[key]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(f, key)
+	return nil
+}
+
+// fakeSegmentRepo is a SegmentRepository over a map, enough for deletes
+type fakeSegmentRepo struct {
+	repository.SegmentRepository
+	segments map[string]domain.Segment
+	deleted  []string
+}
+
+func (f *fakeSegmentRepo) List(ctx context.Context) ([]domain.Segment, error) {
+	var out []domain.Segment
+	for _, s := range f.segments {
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (f *fakeSegmentRepo) Get(ctx context.Context, id string) (*domain.Segment, error) {
+	s, ok := f.segments[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &s, nil
+}
+
+func (f *fakeSegmentRepo) Delete(ctx context.Context, id, author string) error {
+	if _, ok := f.segments[id]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(f.segments, id)
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+// auditedMux routes the handlers under test through withAudit
+func auditedMux(audit repository.AuditRepository, strategies repository.FeatureStrategyRepository, segments repository.SegmentRepository) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feature-strategies/{key}", func(w http.ResponseWriter, r *http.Request) {
+		handleFeatureStrategy(w, r, strategies)
+	})
+	mux.HandleFunc("/segments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleSegment(w, r, segments)
+	})
+	mux.HandleFunc("POST /rules/compile", handleCompileRule)
+	return withAudit(mux, audit)
+}
+
+func jsonEqual(t *testing.T, got json.RawMessage, want string) bool {
+	t.Helper()
+	if want == "" {
+		return len(got) == 0
+	}
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func TestAuditFeatureStrategyChanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		method, path  string
+		body          string
+		actor         string
+		status        int
+		before, after string
+	}{
+		{
+			name:   "replace",
+			method: http.MethodPut, path: "/feature-strategies/banner", body: `{"strategy": "union"}`,
+			actor:  "alice",
+			status: http.StatusOK,
+			before: `{"feature_key": "banner", "strategy": "deep_merge"}`,
+			after:  `{"feature_key": "banner", "strategy": "union"}`,
+		},
+		{
+			name:   "create",
+			method: http.MethodPut, path: "/feature-strategies/tiles", body: `{"strategy": "union"}`,
+			actor:  "alice",
+			status: http.StatusOK,
+			after:  `{"feature_key": "tiles", "strategy": "union"}`,
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete, path: "/feature-strategies/banner",
+			actor:  "bob",
+			status: http.StatusNoContent,
+			before: `{"feature_key": "banner", "strategy": "deep_merge"}`,
+		},
+		{
+			name:   "delete missing",
+			method: http.MethodDelete, path: "/feature-strategies/nope",
+			actor:  "anonymous",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "rejected",
+			method: http.MethodPut, path: "/feature-strategies/banner", body: `{"strategy": "random"}`,
+			actor:  "anonymous",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := &fakeAuditRepo{}
+			handler := auditedMux(audit, fakeStrategyRepo{"banner": domain.MergeStrategy("deep_merge")}, nil)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Request-ID", "req-"+tt.name)
+			if tt.actor != "anonymous" {
+				req.Header.Set("X-Actor", tt.actor)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("X-Request-ID"); got != "req-"+tt.name {
+				t.Errorf("X-Request-ID = %q, want the caller's", got)
+			}
+			if len(audit.entries) != 1 {
+				t.Fatalf("got %d audit entries, want 1", len(audit.entries))
+			}
+			e := audit.entries[0]
+			key := strings.TrimPrefix(tt.path, "/feature-strategies/")
+			if e.Actor != tt.actor || e.Action != tt.method+" /feature-strategies/{key}" || e.ResourceType != "feature-strategies" ||
+				e.ResourceID != key || e.RequestID != "req-"+tt.name || e.Status != tt.status {
+				t.Errorf("entry = %+v", e)
+			}
+			if !jsonEqual(t, e.Before, tt.before) {
+				t.Errorf("before = %s, want %s", e.Before, tt.before)
+			}
+			if !jsonEqual(t, e.After, tt.after) {
+				t.Errorf("after = %s, want %s", e.After, tt.after)
+			}
+		})
+	}
+}
+
+func TestAuditSkipsReads(t *testing.T) {
+	audit := &fakeAuditRepo{}
+	handler := auditedMux(audit, fakeStrategyRepo{}, nil)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/feature-strategies/banner", nil),
+		httptest.NewRequest(http.MethodPost, "/rules/compile", strings.NewReader(`{"rule": "ltv > 5"}`)),
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("X-Request-ID") == "" {
+			t.Errorf("%s %s: no request ID generated", req.Method, req.URL.Path)
+		}
+	}
+	if len(audit.entries) != 0 {
+		t.Errorf("audited %+v", audit.entries)
+	}
+}
+
+func TestAuditSegmentDelete(t *testing.T) {
+	useRedis(t)
+	evaluateSegment = func(context.Context, *sql.DB, *redis.Client, string, *jobs.Tracker) error { return nil }
+	t.Cleanup(func() { evaluateSegment = service.EvaluateSegment })
+
+	const id = "7c1b6f2e-0000-4000-8000-000000000001"
+	existing := domain.Segment{ID: id, Name: "vip", RuleLogic: json.RawMessage(`{">": [{"var": "ltv"}, 100]}`), IsActive: true}
+	segments := &fakeSegmentRepo{segments: map[string]domain.Segment{id: existing}}
+	audit := &fakeAuditRepo{}
+	handler := auditedMux(audit, nil, segments)
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/segments/"+id, nil))
+		if w.Code != status {
+			t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+		}
+	}
+	if !reflect.DeepEqual(segments.deleted, []string{id}) {
+		t.Errorf("deleted %v, want %s once", segments.deleted, id)
+	}
+
+	if len(audit.entries) != 2 {
+		t.Fatalf("got %d audit entries, want 2", len(audit.entries))
+	}
+	want, _ := json.Marshal(existing)
+	if deleted := audit.entries[0]; deleted.ResourceID != id || !jsonEqual(t, deleted.Before, string(want)) {
+		t.Errorf("delete entry = %+v, before = %s", deleted, deleted.Before)
+	}
+	if missing := audit.entries[1]; missing.Status != http.StatusNotFound || len(missing.Before) != 0 {
+		t.Errorf("missing delete entry = %+v", missing)
+	}
+}
+
+func TestHandleAudit(t *testing.T) {
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		query  string
+		page   int
+		status int
+		filter repository.AuditFilter
+		next   interface{}
+	}{
+		{
+			name:   "defaults",
+			status: http.StatusOK,
+			filter: repository.AuditFilter{Limit: 50},
+		},
+		{
+			name:   "filters",
+			query:  "actor=alice&action=PUT+/segments/{id}&resource_type=segments&resource_id=s1&request_id=r1&since=2026-01-02T03:04:05Z&until=2026-01-03T00:00:00Z",
+			status: http.StatusOK,
+			filter: repository.AuditFilter{
+				Actor: "alice", Action: "PUT /segments/{id}", ResourceType: "segments", ResourceID: "s1", RequestID: "r1",
+				Since: since, Until: time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), Limit: 50,
+			},
+		},
+		{
+			name:   "a full page has a cursor",
+			query:  "limit=2",
+			page:   2,
+			status: http.StatusOK,
+			filter: repository.AuditFilter{Limit: 2},
+			next:   "9",
+		},
+		{
+			name:   "a short page is the last",
+			query:  "limit=3&cursor=9",
+			page:   2,
+			status: http.StatusOK,
+			filter: repository.AuditFilter{Limit: 3, BeforeID: 9},
+		},
+		{name: "bad since", query: "since=yesterday", status: http.StatusBadRequest},
+		{name: "bad until", query: "until=2026-01-03", status: http.StatusBadRequest},
+		{name: "limit too large", query: "limit=501", status: http.StatusBadRequest},
+		{name: "bad cursor", query: "cursor=0", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeAuditRepo{}
+			for i := 0; i < tt.page; i++ {
+				repo.page = append(repo.page, domain.AuditEntry{ID: int64(10 - i)})
+			}
+			w := httptest.NewRecorder()
+			handleAudit(w, httptest.NewRequest(http.MethodGet, "/audit?"+tt.query, nil), repo)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if !reflect.DeepEqual(repo.filter, tt.filter) {
+				t.Errorf("filter = %+v, want %+v", repo.filter, tt.filter)
+			}
+			var body struct {
+				Entries    []domain.AuditEntry `json:"entries"`
+				NextCursor interface{}         `json:"next_cursor"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Entries) != tt.page || body.NextCursor != tt.next {
+				t.Errorf("%d entries, next_cursor %v; want %d, %v", len(body.Entries), body.NextCursor, tt.page, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
+	"daffodil-experimentation-platform/internal/service"
+)
+
+// handleDebugEvaluate serves GET /debug/evaluate?userId=&segment=, tracing
+// one segment's rule against one user's live data. segment is a segment
+// ID or name. The response also says whether the cached membership in
+// Redis agrees, since /experiments serves from the cache, and whether the
+// segment is live at all: an inactive segment or one outside its window is
+// not evaluated whatever its rule says.
+func handleDebugEvaluate(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+	ref := r.URL.Query().Get("segment")
+	if userID == "" || ref == "" {
+		http.Error(w, "userId and segment are required", http.StatusBadRequest)
+		return
+	}
+
+	segment, err := segmentRepo.Get(r.Context(), ref)
+	if errors.Is(err, repository.ErrNotFound) {
+		segment, err = segmentRepo.GetByName(r.Context(), ref)
+	}
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	m, err := metricsRepo.GetMetrics(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	attrs, err := attrRepo.List(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rule, err := ruleengine.Compile(segment.RuleLogic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	now := time.Now()
+	data := ruleengine.BuildContext(*m, attrs, now)
+
+	// Segments referenced with in_segment are evaluated first
+	var memberships map[string]bool
+	if len(rule.Dependencies()) > 0 {
+		if memberships, err = service.SegmentMemberships(r.Context(), db, data); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	explanation := rule.Explain(data, memberships)
+
+	cached, err := rdb.SIsMember(r.Context(), "user:segments:"+userID, segment.ID).Result()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Which version of the segment the cached membership came from
+	var cachedVersion interface{}
+	if v, err := rdb.HGet(r.Context(), "user:segment_versions:"+userID, segment.ID).Int(); err == nil {
+		cachedVersion = v
+	}
+
+	resp := map[string]interface{}{
+		"user_id":        userID,
+		"segment":        withDSL(segment),
+		"live":           segment.LiveAt(now),
+		"matched":        explanation.Matched,
+		"failed_clauses": explanation.FailedClauses,
+		"cached_member":  cached,
+		"cached_version": cachedVersion,
+		"context":        data,
+		"trace":          explanation.Trace,
+	}
+	if explanation.Error != "" {
+		resp["error"] = explanation.Error
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"daffodil-experimentation-platform/internal/analysis"
+	"daffodil-experimentation-platform/internal/bucketing"
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/repository"
+)
+
+// experimentRequest is the body accepted by the create and update endpoints
+type experimentRequest struct {
+	Key      string           `json:"key"`
+	Payload  json.RawMessage  `json:"payload"`
+	Variants []domain.Variant `json:"variants"`
+	Salt     string           `json:"salt"`
+	Priority int              `json:"priority"`
+	StartsAt *time.Time       `json:"starts_at"`
+	EndsAt   *time.Time       `json:"ends_at"`
+}
+
+// validate rejects bad input before it reaches Postgres
+func (req *experimentRequest) validate() error {
+	req.Key = strings.TrimSpace(req.Key)
+	if req.Key == "" {
+		return errors.New("key is required")
+	}
+	if err := domain.ValidateWindow(req.StartsAt, req.EndsAt); err != nil {
+		return err
+	}
+
+	// The top-level payload is only served when there are no variants
+	if len(req.Variants) > 0 && len(req.Payload) == 0 {
+		req.Payload = json.RawMessage(`{}`)
+	}
+	if !isJSONObject(req.Payload) {
+		return errors.New("payload must be a JSON object of feature values")
+	}
+
+	if err := bucketing.ValidateVariants(req.Variants); err != nil {
+		return err
+	}
+	for _, v := range req.Variants {
+		if !isJSONObject(v.Payload) {
+			return fmt.Errorf("variant %q payload must be a JSON object of feature values", v.Key)
+		}
+	}
+	return nil
+}
+
+// toExperiment copies the request onto a domain experiment
+func (req *experimentRequest) toExperiment(id, segmentID string) *domain.Experiment {
+	return &domain.Experiment{
+		ID:        id,
+		SegmentID: segmentID,
+		Key:       req.Key,
+		Payload:   req.Payload,
+		Variants:  req.Variants,
+		Salt:      req.Salt,
+		Priority:  req.Priority,
+		StartsAt:  req.StartsAt,
+		EndsAt:    req.EndsAt,
+	}
+}
+
+func isJSONObject(raw json.RawMessage) bool {
+	var obj map[string]interface{}
+	return json.Unmarshal(raw, &obj) == nil && obj != nil
+}
+
+// handleSegmentExperiments serves /segments/{id}/experiments (list, create)
+func handleSegmentExperiments(w http.ResponseWriter, r *http.Request, segments repository.SegmentRepository, repo repository.ExperimentRepository) {
+	segmentID := r.PathValue("id")
+	if _, err := segments.Get(r.Context(), segmentID); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		experiments, err := repo.ListBySegment(r.Context(), segmentID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, http.StatusOK, experiments)
+
+	case http.MethodPost:
+		var req experimentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e := req.toExperiment("", segmentID)
+		e.Variants = bucketing.Allocate(nil, e.Variants)
+		if err := repo.Create(r.Context(), e, actor(r)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		auditAfter(r, e)
+
+		log.Printf("✅ Created experiment %s on segment %s", e.Key, segmentID)
+		writeJSON(w, http.StatusCreated, e)
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// handleExperiment serves /experiments/{id} (get, update, delete)
+func handleExperiment(w http.ResponseWriter, r *http.Request, repo repository.ExperimentRepository) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		e, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+
+	case http.MethodPut:
+		var req experimentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		before, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditBefore(r, before)
+		e := req.toExperiment(id, "")
+		// Users keep their variant unless the new weights leave no room
+		e.Variants = bucketing.Allocate(before.Variants, e.Variants)
+		if err := repo.Update(r.Context(), e, actor(r)); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditAfter(r, e)
+
+		log.Printf("✅ Updated experiment %s (%s)", e.Key, e.ID)
+		writeJSON(w, http.StatusOK, e)
+
+	case http.MethodDelete:
+		e, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditBefore(r, e)
+		if err := repo.Delete(r.Context(), id, actor(r)); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+
+		log.Printf("🗑️ Deleted experiment %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// handleExperimentResults serves GET /experiments/{id}/results
+func handleExperimentResults(w http.ResponseWriter, r *http.Request, repo repository.ExperimentRepository, engine *analysis.Engine) {
+	e, err := repo.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	confidence := 0.95
+	if c := r.URL.Query().Get("confidence"); c != "" {
+		confidence, err = strconv.ParseFloat(c, 64)
+		if err != nil || confidence <= 0 || confidence >= 1 {
+			http.Error(w, "confidence must be a number between 0 and 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := engine.Analyze(r.Context(), e.ID, r.URL.Query().Get("control"), confidence)
+	if errors.Is(err, analysis.ErrUnknownControl) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"experiment": e,
+		"results":    report,
+	})
+}
+
+// handleFeatureStrategies serves GET /feature-strategies
+func handleFeatureStrategies(w http.ResponseWriter, r *http.Request, repo repository.FeatureStrategyRepository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	strategies, err := repo.List(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, http.StatusOK, strategies)
+}
+
+// handleFeatureStrategy serves /feature-strategies/{key} (set, delete)
+func handleFeatureStrategy(w http.ResponseWriter, r *http.Request, repo repository.FeatureStrategyRepository) {
+	key := r.PathValue("key")
+
+	// auditExisting records the strategy being replaced or deleted, if any
+	auditExisting := func() error {
+		strategies, err := repo.List(r.Context())
+		if err != nil {
+			return err
+		}
+		if existing, ok := strategies[key]; ok {
+			auditBefore(r, map[string]interface{}{"feature_key": key, "strategy": existing})
+		}
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Strategy domain.MergeStrategy `json:"strategy"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if !req.Strategy.Valid() {
+			http.Error(w, "strategy must be one of priority, deep_merge, union", http.StatusBadRequest)
+			return
+		}
+		if err := auditExisting(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := repo.Set(r.Context(), key, req.Strategy); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		result := map[string]interface{}{"feature_key": key, "strategy": req.Strategy}
+		auditAfter(r, result)
+		log.Printf("✅ Feature %s now merges with %s", key, req.Strategy)
+		writeJSON(w, http.StatusOK, result)
+
+	case http.MethodDelete:
+		if err := auditExisting(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := repo.Delete(r.Context(), key); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
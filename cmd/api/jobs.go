@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/service"
+)
+
+// evaluateSegment runs a segment job; tests replace it
+var evaluateSegment = service.EvaluateSegment
+
+// segmentJobs tracks the segment evaluations running in this process, so a
+// new job for a segment can wait for the one it superseded to exit
+var segmentJobs = struct {
+	sync.Mutex
+	running map[string]runningJob // by segment ID
+}{running: map[string]runningJob{}}
+
+type runningJob struct {
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the job has exited
+}
+
+// startSegmentJob re-evaluates a created, changed or removed segment for
+// every user in the background, once no other evaluation is running, and
+// names the job in the X-Job-ID response header. A newer job for the same
+// segment cancels this one, whichever API instance started it, since it
+// redoes the work. Failing to start it does not fail the request; the next
+// scheduled evaluation sees the changed rules and evaluates everyone.
+func startSegmentJob(w http.ResponseWriter, segmentID string) {
+	job := jobs.NewJob(service.SegmentJobKind, segmentID)
+	if err := jobStore.Create(ctx, job); err != nil {
+		log.Printf("❌ Failed to start evaluation of segment %s: %v", segmentID, err)
+		return
+	}
+	jobCtx, cancel, err := jobStore.Supersede(ctx, job)
+	if err != nil {
+		log.Printf("❌ Failed to start evaluation of segment %s: %v", segmentID, err)
+		return
+	}
+
+	current := runningJob{id: job.ID, cancel: cancel, done: make(chan struct{})}
+	segmentJobs.Lock()
+	previous, superseding := segmentJobs.running[segmentID]
+	segmentJobs.running[segmentID] = current
+	segmentJobs.Unlock()
+	if superseding {
+		previous.cancel()
+	}
+
+	jobStore.Start(jobCtx, job, func(ctx context.Context, t *jobs.Tracker) error {
+		defer func() {
+			segmentJobs.Lock()
+			if segmentJobs.running[segmentID].id == job.ID {
+				delete(segmentJobs.running, segmentID)
+			}
+			segmentJobs.Unlock()
+			cancel()
+			close(current.done)
+		}()
+
+		if superseding {
+			select {
+			case <-previous.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// Run after any evaluation in progress here, in another API
+		// instance or in cron, rather than race it on the caches. A job
+		// superseded in another instance still holds the lock until it
+		// has exited.
+		lock, err := service.WaitEvaluationLock(ctx, rdb, job.ID)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		err = evaluateSegment(lock.Context(), db, rdb, segmentID, t)
+		if errors.Is(context.Cause(lock.Context()), jobs.ErrLockLost) {
+			return jobs.ErrLockLost
+		}
+		return err
+	})
+	w.Header().Set("X-Job-ID", job.ID)
+}
+
+// handleJob serves GET /jobs/{id}
+func handleJob(w http.ResponseWriter, r *http.Request, store *jobs.Store) {
+	job, err := store.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, jobs.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
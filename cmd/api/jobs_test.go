@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/service"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedis points the API at an in-memory Redis for one test
+func useRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	m := miniredis.RunT(t)
+	rdb = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	jobStore = jobs.NewStore(rdb)
+	t.Cleanup(func() { rdb.Close() })
+	return m
+}
+
+// waitForState polls a job until it reaches want
+func waitForState(t *testing.T, id string, want jobs.State) *jobs.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jobStore.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == want {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.State, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartSegmentJobSupersedesRunningJob(t *testing.T) {
+	useRedis(t)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	firstStarted := make(chan struct{})
+	calls := 0
+	evaluateSegment = func(ctx context.Context, _ *sql.DB, _ *redis.Client, segmentID string, t *jobs.Tracker) error {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+
+		if call == 1 {
+			record("first started")
+			close(firstStarted)
+			<-ctx.Done()
+			// Still writing when cancelled; the next job must not start
+			// before this returns
+			time.Sleep(50 * time.Millisecond)
+			record("first exited")
+			return ctx.Err()
+		}
+		record("second started")
+		t.SetTotal(3)
+		t.Progress(3, 1, map[string]int64{"added": 2, "removed": 1})
+		return nil
+	}
+	t.Cleanup(func() { evaluateSegment = service.EvaluateSegment })
+
+	w := httptest.NewRecorder()
+	startSegmentJob(w, "s1")
+	first := w.Header().Get("X-Job-ID")
+	<-firstStarted
+
+	w = httptest.NewRecorder()
+	startSegmentJob(w, "s1")
+	second := w.Header().Get("X-Job-ID")
+	if first == "" || second == "" || first == second {
+		t.Fatalf("job IDs %q and %q", first, second)
+	}
+
+	waitForState(t, first, jobs.StateCancelled)
+	job := waitForState(t, second, jobs.StateSucceeded)
+	if job.Total != 3 || job.Processed != 3 || job.Errors != 1 || job.Counts["added"] != 2 || job.Counts["removed"] != 1 {
+		t.Errorf("progress = %d/%d, %d errors, counts %v", job.Processed, job.Total, job.Errors, job.Counts)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"first started", "first exited", "second started"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+	}
+
+	segmentJobs.Lock()
+	defer segmentJobs.Unlock()
+	if len(segmentJobs.running) != 0 {
+		t.Errorf("finished jobs still tracked: %v", segmentJobs.running)
+	}
+}
+
+func TestStartSegmentJobWaitsForEvaluationLock(t *testing.T) {
+	useRedis(t)
+
+	started := make(chan struct{})
+	evaluateSegment = func(ctx context.Context, _ *sql.DB, _ *redis.Client, segmentID string, t *jobs.Tracker) error {
+		close(started)
+		return nil
+	}
+	t.Cleanup(func() { evaluateSegment = service.EvaluateSegment })
+
+	// A full evaluation, e.g. cron, holds the lock
+	lock, err := service.LockEvaluation(ctx, rdb, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	startSegmentJob(w, "s1")
+	select {
+	case <-started:
+		t.Fatal("segment job ran while an evaluation held the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.Release()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("segment job did not run once the lock was released")
+	}
+	waitForState(t, w.Header().Get("X-Job-ID"), jobs.StateSucceeded)
+}
@@ -4,11 +4,20 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"daffodil-experimentation-platform/internal/analysis"
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/exposure"
+	"daffodil-experimentation-platform/internal/jobs"
 	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
 	"daffodil-experimentation-platform/internal/service"
 	"daffodil-experimentation-platform/pkg/config"
 	"daffodil-experimentation-platform/pkg/database"
@@ -18,11 +27,19 @@ import (
 )
 
 var (
-	db          *sql.DB
-	rdb         *redis.Client
-	kafkaWriter *kafka.Writer
-	metricsRepo repository.MetricsRepository
-	ctx         = context.Background()
+	db           *sql.DB
+	rdb          *redis.Client
+	kafkaWriter  *kafka.Writer
+	exposures    *exposure.Queue
+	metricsRepo  repository.MetricsRepository
+	segmentRepo  repository.SegmentRepository
+	expRepo      repository.ExperimentRepository
+	strategyRepo repository.FeatureStrategyRepository
+	attrRepo     repository.AttributeRepository
+	versionRepo  repository.SegmentVersionRepository
+	auditRepo    repository.AuditRepository
+	jobStore     *jobs.Store
+	ctx          = context.Background()
 )
 
 func main() {
@@ -45,6 +62,13 @@ func main() {
 	rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
 
 	metricsRepo = repository.NewPostgresMetricsRepository(db)
+	segmentRepo = repository.NewPostgresSegmentRepository(db)
+	expRepo = repository.NewPostgresExperimentRepository(db)
+	strategyRepo = repository.NewPostgresFeatureStrategyRepository(db)
+	attrRepo = repository.NewPostgresAttributeRepository(db)
+	versionRepo = repository.NewPostgresSegmentVersionRepository(db)
+	auditRepo = repository.NewPostgresAuditRepository(db)
+	jobStore = jobs.NewStore(rdb)
 
 	// 3. Setup Kafka Writer
 	kafkaWriter = &kafka.Writer{
@@ -53,17 +77,110 @@ func main() {
 		Balancer: &kafka.LeastBytes{},
 	}
 
+	// 4. Setup exposure logging on its own topic
+	exposureWriter := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.KafkaBroker),
+		Topic:    cfg.ExposureTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	exposures = exposure.NewQueue(exposure.NewLogger(exposureWriter, rdb, cfg.ExposureDedupWindow), cfg.ExposureQueueSize, cfg.ExposureWorkers)
+
 	// 2. Define the endpoint
 	http.HandleFunc("/experiments", getExperiments)
 	http.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
 		handleUsers(w, r, metricsRepo)
 	})
+	http.HandleFunc("/users/{id}/attributes", func(w http.ResponseWriter, r *http.Request) {
+		handleUserAttributes(w, r, attrRepo)
+	})
+	http.HandleFunc("DELETE /users/{id}/attributes/{key}", func(w http.ResponseWriter, r *http.Request) {
+		handleUserAttribute(w, r, attrRepo)
+	})
 	http.HandleFunc("/place-order", handlePlaceOrder)
-	http.HandleFunc("/evaluate", runEvaluation)
+	http.HandleFunc("POST /evaluate", runEvaluation)
 
-	log.Println("🚀 Experiment API started on :8080")
-	log.Fatal(http.ListenAndServe(":"+cfg.APIPort, enableCORS(http.DefaultServeMux)))
+	// Variables segment rules can reference
+	http.HandleFunc("GET /rules/variables", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ruleengine.Catalog)
+	})
+	http.HandleFunc("POST /rules/compile", handleCompileRule)
+	http.HandleFunc("GET /debug/evaluate", handleDebugEvaluate)
+
+	// Segment management
+	http.HandleFunc("/segments", func(w http.ResponseWriter, r *http.Request) {
+		handleSegments(w, r, segmentRepo)
+	})
+	http.HandleFunc("POST /segments/dry-run", handleSegmentDryRun)
+	http.HandleFunc("/segments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleSegment(w, r, segmentRepo)
+	})
+	http.HandleFunc("POST /segments/{id}/activate", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentActivation(w, r, segmentRepo, true)
+	})
+	http.HandleFunc("POST /segments/{id}/deactivate", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentActivation(w, r, segmentRepo, false)
+	})
+	http.HandleFunc("GET /segments/{id}/versions", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentVersions(w, r, versionRepo)
+	})
+	http.HandleFunc("GET /segments/{id}/versions/{version}", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentVersion(w, r, versionRepo)
+	})
+	http.HandleFunc("POST /segments/{id}/versions/{version}/rollback", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentRollback(w, r, versionRepo, segmentRepo)
+	})
 
+	// Experiment management
+	http.HandleFunc("/segments/{id}/experiments", func(w http.ResponseWriter, r *http.Request) {
+		handleSegmentExperiments(w, r, segmentRepo, expRepo)
+	})
+	http.HandleFunc("/experiments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleExperiment(w, r, expRepo)
+	})
+	http.HandleFunc("GET /experiments/{id}/results", func(w http.ResponseWriter, r *http.Request) {
+		handleExperimentResults(w, r, expRepo, analysis.NewEngine(db))
+	})
+	http.HandleFunc("/feature-strategies", func(w http.ResponseWriter, r *http.Request) {
+		handleFeatureStrategies(w, r, strategyRepo)
+	})
+	http.HandleFunc("/feature-strategies/{key}", func(w http.ResponseWriter, r *http.Request) {
+		handleFeatureStrategy(w, r, strategyRepo)
+	})
+
+	// Who changed what
+	http.HandleFunc("GET /audit", func(w http.ResponseWriter, r *http.Request) {
+		handleAudit(w, r, auditRepo)
+	})
+
+	// Background jobs, e.g. re-evaluating a changed segment
+	http.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleJob(w, r, jobStore)
+	})
+
+	server := &http.Server{Addr: ":" + cfg.APIPort, Handler: enableCORS(withAudit(http.DefaultServeMux, auditRepo))}
+	go func() {
+		log.Println("🚀 Experiment API started on :8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// On shutdown, finish the requests in flight, then publish the
+	// exposures they queued
+	stop, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+	log.Println("⏹️ Shutting down")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("❌ Shutdown Error: %v", err)
+	}
+	if err := exposures.Close(shutdownCtx); err != nil {
+		log.Printf("❌ Exposures still queued at shutdown: %v", err)
+	}
+	exposureWriter.Close()
 }
 
 func getExperiments(w http.ResponseWriter, r *http.Request) {
@@ -75,33 +192,77 @@ func getExperiments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 3. Fetch segment names from Redis Set
-	segments, err := rdb.SMembers(ctx, "user:segments:"+userID).Result()
+	// 3. Fetch segment IDs from Redis Set
+	segmentIDs, err := rdb.SMembers(ctx, "user:segments:"+userID).Result()
 	if err != nil {
 		log.Printf("Redis Error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// 4. Response Structure
-	response := map[string]interface{}{
-		"user_id":  userID,
-		"segments": segments,
-		"features": make(map[string]interface{}),
-	}
-
-	// Apply logic based on segments found in Redis
-	features := response["features"].(map[string]interface{})
-	for _, s := range segments {
-		// Matching the name we seeded in init.sql
-		if s == "Power User" {
-			features["show_pizza_tile"] = true
-			features["home_banner"] = "Premium_Banner_V1"
-			features["discount_pct"] = 15
+	// 4. Load the experiments attached to those segments
+	experiments, err := expRepo.ListForSegmentIDs(r.Context(), segmentIDs)
+	if err != nil {
+		log.Printf("DB Error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Names are only for display; targeting goes by ID
+	names, err := segmentRepo.Names(r.Context(), segmentIDs)
+	if err != nil {
+		log.Printf("DB Error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	segments := make([]string, 0, len(segmentIDs))
+	for _, id := range segmentIDs {
+		if name, ok := names[id]; ok {
+			segments = append(segments, name)
 		}
 	}
 
-	// 5. Log request for the demo
+	strategies, err := strategyRepo.List(r.Context())
+	if err != nil {
+		log.Printf("DB Error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	assignments := service.AssignVariants(userID, experiments)
+	features, sources := service.ResolveFeatures(assignments, strategies)
+
+	variants := make(map[string]string, len(assignments))
+	events := make([]domain.ExposureEvent, 0, len(assignments))
+	for _, a := range assignments {
+		variants[a.Experiment.Key] = a.Variant.Key
+		events = append(events, domain.ExposureEvent{
+			UserID:        userID,
+			ExperimentID:  a.Experiment.ID,
+			ExperimentKey: a.Experiment.Key,
+			Variant:       a.Variant.Key,
+			SegmentID:     a.Experiment.SegmentID,
+			SegmentName:   a.Experiment.SegmentName,
+			Timestamp:     start,
+		})
+	}
+
+	// Record what was served off the request path; Kafka latency shouldn't
+	// slow down the app's home screen
+	if !exposures.Enqueue(events) {
+		log.Printf("⚠️ Exposure queue full, dropped %d exposures for %s", len(events), userID)
+	}
+
+	// 5. Response Structure
+	response := map[string]interface{}{
+		"user_id":     userID,
+		"segments":    segments,
+		"segment_ids": segmentIDs,
+		"features":    features,
+		"variants":    variants,
+		"explanation": sources,
+	}
+
+	// 6. Log request for the demo
 	log.Printf("GET /experiments?userId=%s - Found %d segments - Latency: %v", userID, len(segments), time.Since(start))
 
 	w.Header().Set("Content-Type", "application/json")
@@ -139,6 +300,8 @@ func handleUsers(w http.ResponseWriter, r *http.Request, repo repository.Metrics
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		auditResource(r, req.UserID)
+		auditAfter(r, req)
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -179,29 +342,89 @@ func handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	auditResource(r, req.UserID)
+	auditAfter(r, req)
 	log.Printf("✅ Produced %d orders for %s to Kafka", req.Count, req.UserID)
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// runEvaluation serves POST /evaluate. It starts a full evaluation as a
+// background job and returns the job, whose status is at GET /jobs/{id}.
+// Only one evaluation runs at a time, here or in cron.
 func runEvaluation(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	job := jobs.NewJob(service.EvaluationJobKind, "")
+	// The lock outlives the request, like the job
+	lock, err := service.LockEvaluation(ctx, rdb, job.ID)
+	if errors.Is(err, jobs.ErrLocked) {
+		holder, _ := service.EvaluationLockHolder(r.Context(), rdb)
+		http.Error(w, "an evaluation is already running: "+holder, http.StatusConflict)
 		return
 	}
-
-	// Use the shared service
-	err := service.RunEvaluation(ctx, db, rdb)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	if err := jobStore.Create(r.Context(), job); err != nil {
+		lock.Release()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Respond before the job starts changing it
+	w.Header().Set("X-Job-ID", job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+
+	jobStore.Start(lock.Context(), job, func(ctx context.Context, t *jobs.Tracker) error {
+		defer lock.Release()
+		stats, err := service.Evaluate(ctx, db, rdb, service.EvaluationOptions{
+			Progress: func(s service.EvaluationStats) {
+				if s.Users == 0 {
+					t.SetTotal(s.Total)
+				}
+				t.SetProgress(s.Users, s.Errors, map[string]int64{"memberships": s.Memberships, "batches": s.Batches})
+			},
+		})
+		if stats != nil {
+			t.SetResult(stats)
+		}
+		if errors.Is(context.Cause(ctx), jobs.ErrLockLost) {
+			return jobs.ErrLockLost
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("✅ Evaluated %d users (%.0f/s), %d errors", stats.Users, stats.UsersPerSecond, stats.Errors)
+		return nil
+	})
+}
+
+// writeJSON encodes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeRepoError maps repository errors onto HTTP status codes
+func writeRepoError(w http.ResponseWriter, err error) {
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Repo Error: %v", err)
+	http.Error(w, err.Error(), 500)
 }
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3001")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Actor, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Job-ID")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
+	"daffodil-experimentation-platform/internal/service"
+)
+
+// segmentRequest is the body accepted by the create and update endpoints.
+// The rule is given either as JSON-Logic or as a DSL string in "rule".
+// starts_at and ends_at schedule the segment; leaving them out means no
+// limit on that side.
+type segmentRequest struct {
+	Name      string          `json:"name"`
+	RuleLogic json.RawMessage `json:"rule_logic"`
+	Rule      string          `json:"rule"`
+	IsActive  *bool           `json:"is_active"`
+	StartsAt  *time.Time      `json:"starts_at"`
+	EndsAt    *time.Time      `json:"ends_at"`
+}
+
+// validate rejects bad input before it reaches Postgres, compiling a DSL
+// rule into RuleLogic
+func (req *segmentRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := domain.ValidateWindow(req.StartsAt, req.EndsAt); err != nil {
+		return err
+	}
+	if err := req.compileRule(); err != nil {
+		return err
+	}
+	return ruleengine.Validate(req.RuleLogic)
+}
+
+func (req *segmentRequest) compileRule() error {
+	if strings.TrimSpace(req.Rule) == "" {
+		return nil
+	}
+	if len(req.RuleLogic) > 0 && string(req.RuleLogic) != "null" {
+		return errors.New("give either rule or rule_logic, not both")
+	}
+	logic, err := ruleengine.CompileDSL(req.Rule)
+	if err != nil {
+		return err
+	}
+	req.RuleLogic = logic
+	return nil
+}
+
+// checkSegmentGraph verifies in_segment references across all segments as
+// they would be after saving changed (if not nil) and deleting removedID
+// (if not empty): changed's name must be free, every reference must resolve
+// and none may form a cycle.
+func checkSegmentGraph(ctx context.Context, repo repository.SegmentRepository, changed *domain.Segment, removedID string) error {
+	segments, err := repo.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rules []ruleengine.NamedRule
+	replaced := false
+	for _, s := range segments {
+		if s.ID == removedID {
+			continue
+		}
+		if changed != nil && s.ID == changed.ID {
+			s, replaced = *changed, true
+		} else if changed != nil && s.Name == changed.Name {
+			return fmt.Errorf("segment name %q %w", s.Name, repository.ErrConflict)
+		}
+		rule, err := ruleengine.Compile(s.RuleLogic)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, ruleengine.NamedRule{ID: s.ID, Name: s.Name, Rule: rule})
+	}
+	if changed != nil && !replaced {
+		rule, err := ruleengine.Compile(changed.RuleLogic)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, ruleengine.NamedRule{ID: changed.ID, Name: changed.Name, Rule: rule})
+	}
+	return ruleengine.CheckDependencies(rules)
+}
+
+// writeGraphError reports a failed checkSegmentGraph: a taken name is a
+// conflict, anything else a bad rule
+func writeGraphError(w http.ResponseWriter, err error) {
+	if errors.Is(err, repository.ErrConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// withDSL fills in the DSL form of a segment's rule for display. Rules the
+// DSL cannot express are left as JSON-Logic only.
+func withDSL(s *domain.Segment) *domain.Segment {
+	if dsl, err := ruleengine.Decompile(s.RuleLogic); err == nil {
+		s.RuleDSL = dsl
+	}
+	return s
+}
+
+// handleCompileRule serves POST /rules/compile, translating between the DSL
+// and JSON-Logic in either direction so editors can preview a rule
+func handleCompileRule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Rule      string          `json:"rule"`
+		RuleLogic json.RawMessage `json:"rule_logic"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	logic := req.RuleLogic
+	if strings.TrimSpace(req.Rule) != "" {
+		compiled, err := ruleengine.CompileDSL(req.Rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logic = compiled
+	}
+	if err := ruleengine.Validate(logic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dsl, err := ruleengine.Decompile(logic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rule":       dsl,
+		"rule_logic": logic,
+	})
+}
+
+// handleSegments serves /segments (list, create)
+func handleSegments(w http.ResponseWriter, r *http.Request, repo repository.SegmentRepository) {
+	switch r.Method {
+	case http.MethodGet:
+		segments, err := repo.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for i := range segments {
+			withDSL(&segments[i])
+		}
+		writeJSON(w, http.StatusOK, segments)
+
+	case http.MethodPost:
+		var req segmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s := &domain.Segment{Name: req.Name, RuleLogic: req.RuleLogic, IsActive: true, StartsAt: req.StartsAt, EndsAt: req.EndsAt}
+		if req.IsActive != nil {
+			s.IsActive = *req.IsActive
+		}
+		if err := checkSegmentGraph(r.Context(), repo, s, ""); err != nil {
+			writeGraphError(w, err)
+			return
+		}
+		if err := repo.Create(r.Context(), s, actor(r)); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditResource(r, s.ID)
+		auditAfter(r, s)
+		startSegmentJob(w, s.ID)
+
+		log.Printf("✅ Created segment %s (%s)", s.Name, s.ID)
+		writeJSON(w, http.StatusCreated, withDSL(s))
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// handleSegment serves /segments/{id} (get, update, delete)
+func handleSegment(w http.ResponseWriter, r *http.Request, repo repository.SegmentRepository) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, withDSL(s))
+
+	case http.MethodPut:
+		existing, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditBefore(r, existing)
+
+		var req segmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		existing.Name = req.Name
+		existing.RuleLogic = req.RuleLogic
+		existing.StartsAt, existing.EndsAt = req.StartsAt, req.EndsAt
+		if req.IsActive != nil {
+			existing.IsActive = *req.IsActive
+		}
+		// Renaming a referenced segment would break the rules that use it
+		if err := checkSegmentGraph(r.Context(), repo, existing, ""); err != nil {
+			writeGraphError(w, err)
+			return
+		}
+		if err := repo.Update(r.Context(), existing, actor(r)); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditAfter(r, existing)
+		startSegmentJob(w, existing.ID)
+
+		log.Printf("✅ Updated segment %s (%s)", existing.Name, existing.ID)
+		writeJSON(w, http.StatusOK, withDSL(existing))
+
+	case http.MethodDelete:
+		existing, err := repo.Get(r.Context(), id)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		auditBefore(r, existing)
+		if err := checkSegmentGraph(r.Context(), repo, nil, id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := repo.Delete(r.Context(), id, actor(r)); err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		startSegmentJob(w, id)
+
+		log.Printf("🗑️ Deleted segment %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// handleSegmentDryRun serves POST /segments/dry-run, estimating how many
+// users a draft rule would catch before the segment is saved or activated
+func handleSegmentDryRun(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RuleLogic  json.RawMessage `json:"rule_logic"`
+		Rule       string          `json:"rule"`
+		SampleSize int             `json:"sample_size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	draft := segmentRequest{RuleLogic: req.RuleLogic, Rule: req.Rule}
+	if err := draft.compileRule(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ruleengine.Validate(draft.RuleLogic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := service.DryRun(r.Context(), db, draft.RuleLogic, req.SampleSize)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleSegmentActivation serves POST /segments/{id}/activate and /deactivate
+func handleSegmentActivation(w http.ResponseWriter, r *http.Request, repo repository.SegmentRepository, active bool) {
+	id := r.PathValue("id")
+	before, err := repo.Get(r.Context(), id)
+	if err == nil {
+		auditBefore(r, before)
+	}
+	if err := repo.SetActive(r.Context(), id, active, actor(r)); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	s, err := repo.Get(r.Context(), id)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	auditAfter(r, s)
+	startSegmentJob(w, s.ID)
+	log.Printf("✅ Segment %s is_active=%v", s.Name, s.IsActive)
+	writeJSON(w, http.StatusOK, withDSL(s))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/repository"
+)
+
+// actor is who made a change, from the X-Actor header set by the dashboard
+func actor(r *http.Request) string {
+	if a := strings.TrimSpace(r.Header.Get("X-Actor")); a != "" {
+		return a
+	}
+	return "anonymous"
+}
+
+// handleSegmentVersions serves GET /segments/{id}/versions, newest first
+func handleSegmentVersions(w http.ResponseWriter, r *http.Request, repo repository.SegmentVersionRepository) {
+	versions, err := repo.List(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// handleSegmentVersion serves GET /segments/{id}/versions/{version}
+func handleSegmentVersion(w http.ResponseWriter, r *http.Request, repo repository.SegmentVersionRepository) {
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+		return
+	}
+	v, err := repo.Get(r.Context(), r.PathValue("id"), version)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// handleSegmentRollback serves POST /segments/{id}/versions/{version}/rollback.
+// The restored state is saved as a new version.
+func handleSegmentRollback(w http.ResponseWriter, r *http.Request, repo repository.SegmentVersionRepository, segments repository.SegmentRepository) {
+	id := r.PathValue("id")
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+		return
+	}
+
+	target, err := repo.Get(r.Context(), id, version)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	// The old rule may reference segments that have since changed
+	restored := &domain.Segment{ID: id, Name: target.Name, RuleLogic: target.RuleLogic, IsActive: target.IsActive}
+	if err := checkSegmentGraph(r.Context(), segments, restored, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	current, err := segments.Get(r.Context(), id)
+	if err == nil {
+		auditBefore(r, current)
+	}
+	v, err := repo.Rollback(r.Context(), id, version, actor(r))
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	auditAfter(r, v)
+	startSegmentJob(w, id)
+
+	log.Printf("⏪ Rolled segment %s back to v%d as v%d (%s)", v.Name, version, v.Version, v.Author)
+	writeJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// windowCheckpointKey holds the time the cron last looked for segments and
+// experiments whose scheduled windows opened or closed
+const windowCheckpointKey = "cron:window_checked_at"
+
+// lastWindowCheck returns when transitions were last looked for, or the
+// zero time on the first run so every window that already opened is
+// picked up once
+func lastWindowCheck(ctx context.Context, rdb *redis.Client) time.Time {
+	s, err := rdb.Get(ctx, windowCheckpointKey).Result()
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func saveWindowCheck(ctx context.Context, rdb *redis.Client, now time.Time) {
+	if err := rdb.Set(ctx, windowCheckpointKey, now.UTC().Format(time.RFC3339Nano), 0).Err(); err != nil {
+		log.Printf("❌ Failed to save window checkpoint: %v", err)
+	}
+}
+
+// logWindowChanges logs the segments and experiments whose starts_at or
+// ends_at fell in (since, now] and returns how many there were
+func logWindowChanges(ctx context.Context, db *sql.DB, since, now time.Time) (int, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT 'Segment ' || name, COALESCE(ends_at > $1 AND ends_at <= $2, false)
+        FROM segments
+        WHERE (starts_at > $1 AND starts_at <= $2) OR (ends_at > $1 AND ends_at <= $2)
+        UNION ALL
+        SELECT 'Experiment ' || e.experiment_key || ' on ' || s.name, COALESCE(e.ends_at > $1 AND e.ends_at <= $2, false)
+        FROM experiments e JOIN segments s ON s.id = e.segment_id
+        WHERE (e.starts_at > $1 AND e.starts_at <= $2) OR (e.ends_at > $1 AND e.ends_at <= $2)`, since, now)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	changes := 0
+	for rows.Next() {
+		var what string
+		var ended bool
+		if err := rows.Scan(&what, &ended); err != nil {
+			return changes, err
+		}
+		if ended {
+			log.Printf("⏹️ %s has expired", what)
+		} else {
+			log.Printf("▶️ %s has started", what)
+		}
+		changes++
+	}
+	return changes, rows.Err()
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"log"
 
+	"daffodil-experimentation-platform/internal/domain"
 	"daffodil-experimentation-platform/internal/repository"
 	"daffodil-experimentation-platform/internal/service" // Ensure this path is correct
+	"daffodil-experimentation-platform/pkg/config"
 	"daffodil-experimentation-platform/pkg/database"
 
 	_ "github.com/lib/pq"
@@ -55,10 +57,36 @@ func main() {
 	})
 	defer reader.Close()
 
-	log.Println("🚀 Worker started: Listening for order events...")
+	appCfg := config.LoadConfig()
+
+	// 4. Setup the exposure reader; exposures are stored for results analysis
+	exposureReader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{"127.0.0.1:9092"},
+		Topic:    appCfg.ExposureTopic,
+		GroupID:  "exposure-group",
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+	defer exposureReader.Close()
+	go consumeExposures(ctx, exposureReader, repository.NewPostgresExposureRepository(db))
 
 	metricsRepo := repository.NewPostgresMetricsRepository(db)
 
+	// 5. Setup the attribute reader; custom targeting properties from other services
+	attributeReader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{"127.0.0.1:9092"},
+		Topic:    appCfg.AttributeTopic,
+		GroupID:  "attribute-group",
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+	defer attributeReader.Close()
+	go consumeAttributes(ctx, attributeReader, metricsRepo, repository.NewPostgresAttributeRepository(db), func(userID string) error {
+		return service.EvaluateSpecificUser(ctx, db, rdb, userID)
+	})
+
+	log.Println("🚀 Worker started: Listening for order events...")
+
 	for {
 		m, err := reader.ReadMessage(ctx)
 		if err != nil {
@@ -109,3 +137,73 @@ func main() {
 		}
 	}
 }
+
+// consumeExposures stores every exposure event published by the API
+func consumeExposures(ctx context.Context, reader *kafka.Reader, repo repository.ExposureRepository) {
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			log.Printf("Error reading exposure: %v", err)
+			continue
+		}
+
+		var event domain.ExposureEvent
+		if err := json.Unmarshal(m.Value, &event); err != nil {
+			log.Printf("Failed to unmarshal exposure: %v", err)
+			continue
+		}
+
+		if err := repo.Record(ctx, event); err != nil {
+			log.Printf("Repo Error: %v", err)
+			continue
+		}
+		log.Printf("👀 Exposure: User=%s, Experiment=%s, Variant=%s", event.UserID, event.ExperimentKey, event.Variant)
+	}
+}
+
+// consumeAttributes stores custom user attributes and, for InstantSync
+// events, re-evaluates the user straight away
+func consumeAttributes(ctx context.Context, reader *kafka.Reader, metrics repository.MetricsRepository, repo repository.AttributeRepository, evaluate func(string) error) {
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			log.Printf("Error reading attributes: %v", err)
+			continue
+		}
+
+		var event domain.AttributeEvent
+		if err := json.Unmarshal(m.Value, &event); err != nil {
+			log.Printf("Failed to unmarshal attributes: %v", err)
+			continue
+		}
+
+		valid := event.Attributes[:0]
+		for _, a := range event.Attributes {
+			if err := a.Validate(); err != nil {
+				log.Printf("Dropping attribute for %s: %v", event.UserID, err)
+				continue
+			}
+			valid = append(valid, a)
+		}
+		if event.UserID == "" || len(valid) == 0 {
+			continue
+		}
+
+		if err := metrics.EnsureUser(ctx, event.UserID); err != nil {
+			log.Printf("Repo Error: %v", err)
+			continue
+		}
+		if err := repo.Set(ctx, event.UserID, valid); err != nil {
+			log.Printf("Repo Error: %v", err)
+			continue
+		}
+		log.Printf("🏷️ Set %d attributes for user: %s", len(valid), event.UserID)
+
+		if event.InstantSync {
+			log.Printf("⚡ [HOT PATH] Re-evaluating segments for: %s", event.UserID)
+			if err := evaluate(event.UserID); err != nil {
+				log.Printf("Error in evaluation: %v", err)
+			}
+		}
+	}
+}
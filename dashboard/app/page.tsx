@@ -43,7 +43,11 @@ export default function Dashboard() {
 
   const handleSync = async () => {
     setLoading(true);
-    await fetch("http://localhost:8080/evaluate", { method: 'POST' });
+    let job = await api.evaluate();
+    while (job && (job.state === 'queued' || job.state === 'running')) {
+      await new Promise(resolve => setTimeout(resolve, 1000));
+      job = await api.getJob(job.id);
+    }
     const newExp = await api.getExperiments(selectedUser!);
     setExp(newExp);
     setLoading(false);
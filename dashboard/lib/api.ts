@@ -10,6 +10,17 @@ export interface ExperimentResponse {
     };
 }
 
+export interface Job {
+    id: string;
+    kind: string;
+    state: 'queued' | 'running' | 'succeeded' | 'failed' | 'cancelled';
+    processed: number;
+    total: number;
+    counts: Record<string, number>;
+    errors: number;
+    error?: string;
+}
+
 export const api = {
     getUsers: () => fetch(`${API_BASE}/users`).then(res => res.json()),
 
@@ -32,4 +43,11 @@ export const api = {
 
     getExperiments: (userId: string): Promise<ExperimentResponse> =>
         fetch(`${API_BASE}/experiments?userId=${userId}`).then(res => res.json()),
+
+    // Starts a full evaluation; resolves to the job, or null if one is already running
+    evaluate: (): Promise<Job | null> =>
+        fetch(`${API_BASE}/evaluate`, { method: 'POST' }).then(res => res.ok ? res.json() : null),
+
+    getJob: (id: string): Promise<Job> =>
+        fetch(`${API_BASE}/jobs/${id}`).then(res => res.json()),
 };
\ No newline at end of file
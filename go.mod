@@ -2,15 +2,21 @@ module daffodil-experimentation-platform
 
 go 1.25.6
 
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/diegoholiveira/jsonlogic/v3 v3.9.0
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.11.2
+	github.com/redis/go-redis/v9 v9.17.3
+	github.com/segmentio/kafka-go v0.4.50
+)
+
 require (
 	github.com/barkimedes/go-deepcopy v0.0.0-20220514131651-17c30cfc62df // indirect
-	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/diegoholiveira/jsonlogic/v3 v3.9.0 // indirect
-	github.com/joho/godotenv v1.5.1
 	github.com/klauspost/compress v1.15.9 // indirect
-	github.com/lib/pq v1.11.2 // indirect
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
-	github.com/redis/go-redis/v9 v9.17.3 // indirect
-	github.com/segmentio/kafka-go v0.4.50 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
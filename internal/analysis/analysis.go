@@ -0,0 +1,192 @@
+// Package analysis computes experiment results by joining exposures with
+// the order events recorded by the worker.
+package analysis
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultControl is the variant compared against when none is requested
+const DefaultControl = "control"
+
+// ErrUnknownControl is returned when the requested control variant has no exposures
+var ErrUnknownControl = errors.New("control variant has no exposures")
+
+// VariantStats summarises one arm of an experiment. A user counts from their
+// first exposure to the experiment; only orders placed after that are
+// attributed to the variant.
+type VariantStats struct {
+	Variant        string  `json:"variant"`
+	Users          int64   `json:"users"`
+	Converters     int64   `json:"converters"`
+	ConversionRate float64 `json:"conversion_rate"`
+	Orders         int64   `json:"orders"`
+	Revenue        float64 `json:"revenue"`
+	AvgSpend       float64 `json:"avg_spend"` // revenue per exposed user, including non-buyers
+	SpendVariance  float64 `json:"spend_variance"`
+}
+
+// Comparison measures a treatment variant against the control variant
+type Comparison struct {
+	Variant string `json:"variant"`
+
+	ConversionLift float64    `json:"conversion_lift"` // relative, e.g. 0.12 = +12%
+	ConversionDiff Interval   `json:"conversion_diff_ci"`
+	ConversionTest TestResult `json:"conversion_test"`
+
+	SpendLift float64    `json:"spend_lift"`
+	SpendDiff Interval   `json:"spend_diff_ci"`
+	SpendTest TestResult `json:"spend_test"`
+}
+
+// Report is the full result of an experiment
+type Report struct {
+	ExperimentID string         `json:"experiment_id"`
+	Control      string         `json:"control"`
+	Confidence   float64        `json:"confidence"`
+	Variants     []VariantStats `json:"variants"`
+	Comparisons  []Comparison   `json:"comparisons"`
+	GeneratedAt  time.Time      `json:"generated_at"`
+}
+
+// Engine runs the results queries against Postgres
+type Engine struct {
+	db *sql.DB
+}
+
+func NewEngine(db *sql.DB) *Engine {
+	return &Engine{db: db}
+}
+
+// Aggregates are computed per user first (orders and spend after the first
+// exposure), then per variant, so Postgres does the heavy lifting and we only
+// pull one row per variant. Users exposed to more than one variant (e.g. after
+// a salt change) are counted in each. Orders seeded by the order_events
+// backfill are not real orders and are left out.
+const variantQuery = `
+    WITH exposed AS (
+        SELECT user_id, variant, MIN(exposed_at) AS first_exposed_at
+        FROM experiment_exposures
+        WHERE experiment_id = $1
+        GROUP BY user_id, variant
+    ),
+    per_user AS (
+        SELECT x.variant,
+               COUNT(o.id) AS orders,
+               COALESCE(SUM(o.amount), 0)::float8 AS spend
+        FROM exposed x
+        LEFT JOIN order_events o
+               ON o.user_id = x.user_id AND o.created_at >= x.first_exposed_at AND NOT o.backfilled
+        GROUP BY x.variant, x.user_id
+    )
+    SELECT variant,
+           COUNT(*),
+           COUNT(*) FILTER (WHERE orders > 0),
+           COALESCE(SUM(orders), 0),
+           COALESCE(SUM(spend), 0),
+           COALESCE(VAR_SAMP(spend), 0)
+    FROM per_user
+    GROUP BY variant
+    ORDER BY variant`
+
+// Analyze builds the report for an experiment. control names the baseline
+// variant; when empty, "control" is used if present, else the first variant.
+func (e *Engine) Analyze(ctx context.Context, experimentID, control string, confidence float64) (*Report, error) {
+	if confidence <= 0 || confidence >= 1 {
+		return nil, fmt.Errorf("confidence must be between 0 and 1, got %v", confidence)
+	}
+
+	rows, err := e.db.QueryContext(ctx, variantQuery, experimentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &Report{
+		ExperimentID: experimentID,
+		Confidence:   confidence,
+		Variants:     []VariantStats{},
+		Comparisons:  []Comparison{},
+		GeneratedAt:  time.Now(),
+	}
+	for rows.Next() {
+		var v VariantStats
+		if err := rows.Scan(&v.Variant, &v.Users, &v.Converters, &v.Orders, &v.Revenue, &v.SpendVariance); err != nil {
+			return nil, err
+		}
+		if v.Users > 0 {
+			v.ConversionRate = float64(v.Converters) / float64(v.Users)
+			v.AvgSpend = v.Revenue / float64(v.Users)
+		}
+		report.Variants = append(report.Variants, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(report.Variants) == 0 {
+		return report, nil
+	}
+
+	base, err := pickControl(report.Variants, control)
+	if err != nil {
+		return nil, err
+	}
+	report.Control = base.Variant
+
+	for _, v := range report.Variants {
+		if v.Variant == base.Variant {
+			continue
+		}
+		report.Comparisons = append(report.Comparisons, compare(v, base, confidence))
+	}
+	sort.Slice(report.Comparisons, func(i, j int) bool {
+		return report.Comparisons[i].Variant < report.Comparisons[j].Variant
+	})
+	return report, nil
+}
+
+func pickControl(variants []VariantStats, control string) (VariantStats, error) {
+	if control == "" {
+		control = DefaultControl
+		for _, v := range variants {
+			if v.Variant == control {
+				return v, nil
+			}
+		}
+		return variants[0], nil
+	}
+	for _, v := range variants {
+		if v.Variant == control {
+			return v, nil
+		}
+	}
+	return VariantStats{}, fmt.Errorf("%w: %q", ErrUnknownControl, control)
+}
+
+func compare(t, c VariantStats, confidence float64) Comparison {
+	cmp := Comparison{Variant: t.Variant}
+
+	cmp.ConversionTest, cmp.ConversionDiff = twoProportionZTest(
+		float64(t.Converters), float64(t.Users),
+		float64(c.Converters), float64(c.Users),
+		confidence,
+	)
+	if c.ConversionRate > 0 {
+		cmp.ConversionLift = (t.ConversionRate - c.ConversionRate) / c.ConversionRate
+	}
+
+	cmp.SpendTest, cmp.SpendDiff = welchTTest(
+		t.AvgSpend, t.SpendVariance, float64(t.Users),
+		c.AvgSpend, c.SpendVariance, float64(c.Users),
+		confidence,
+	)
+	if c.AvgSpend > 0 {
+		cmp.SpendLift = (t.AvgSpend - c.AvgSpend) / c.AvgSpend
+	}
+	return cmp
+}
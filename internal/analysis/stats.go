@@ -0,0 +1,184 @@
+package analysis
+
+import "math"
+
+// normalCDF is the standard normal cumulative distribution function
+func normalCDF(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+// normalQuantile inverts normalCDF by bisection; plenty fast for one call per request
+func normalQuantile(p float64) float64 {
+	lo, hi := -10.0, 10.0
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if normalCDF(mid) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// studentTCDF is the CDF of Student's t distribution with df degrees of freedom
+func studentTCDF(t, df float64) float64 {
+	if math.IsInf(df, 1) {
+		return normalCDF(t)
+	}
+	x := df / (df + t*t)
+	tail := 0.5 * regIncBeta(df/2, 0.5, x)
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// studentTQuantile inverts studentTCDF by bisection
+func studentTQuantile(p, df float64) float64 {
+	lo, hi := -1000.0, 1000.0
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		if studentTCDF(mid, df) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// regIncBeta is the regularized incomplete beta function I_x(a, b),
+// evaluated with the continued fraction from Numerical Recipes.
+func regIncBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+
+	// The continued fraction converges quickly only below this point
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(a, b, x) / a
+	}
+	return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+}
+
+func betaContinuedFraction(a, b, x float64) float64 {
+	const (
+		maxIter = 300
+		eps     = 1e-14
+		tiny    = 1e-300
+	)
+
+	qab, qap, qam := a+b, a+1, a-1
+	c, d := 1.0, 1-qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxIter; m++ {
+		fm := float64(m)
+		m2 := 2 * fm
+
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return h
+}
+
+// TestResult is the outcome of a two-sided significance test
+type TestResult struct {
+	Test        string  `json:"test"`
+	Statistic   float64 `json:"statistic"`
+	DF          float64 `json:"df,omitempty"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+}
+
+// Interval is a confidence interval on the treatment minus control difference
+type Interval struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// twoProportionZTest compares conversion rates x1/n1 (treatment) and x2/n2
+// (control) with a pooled z-test, and returns an unpooled (Wald) interval on
+// the difference.
+func twoProportionZTest(x1, n1, x2, n2, confidence float64) (TestResult, Interval) {
+	res := TestResult{Test: "two_proportion_z", PValue: 1}
+	if n1 == 0 || n2 == 0 {
+		return res, Interval{}
+	}
+
+	p1, p2 := x1/n1, x2/n2
+	pooled := (x1 + x2) / (n1 + n2)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/n1 + 1/n2))
+	if se > 0 {
+		res.Statistic = (p1 - p2) / se
+		res.PValue = 2 * (1 - normalCDF(math.Abs(res.Statistic)))
+	}
+	res.Significant = res.PValue < 1-confidence
+
+	z := normalQuantile(1 - (1-confidence)/2)
+	seDiff := math.Sqrt(p1*(1-p1)/n1 + p2*(1-p2)/n2)
+	diff := p1 - p2
+	return res, Interval{Low: diff - z*seDiff, High: diff + z*seDiff}
+}
+
+// welchTTest compares two means with unequal variances and returns a
+// Welch–Satterthwaite interval on the difference (treatment minus control).
+func welchTTest(mean1, var1, n1, mean2, var2, n2, confidence float64) (TestResult, Interval) {
+	res := TestResult{Test: "welch_t", PValue: 1}
+	if n1 < 2 || n2 < 2 {
+		return res, Interval{}
+	}
+
+	v1, v2 := var1/n1, var2/n2
+	se := math.Sqrt(v1 + v2)
+	diff := mean1 - mean2
+	if se == 0 {
+		return res, Interval{Low: diff, High: diff}
+	}
+
+	res.DF = (v1 + v2) * (v1 + v2) / (v1*v1/(n1-1) + v2*v2/(n2-1))
+	res.Statistic = diff / se
+	res.PValue = 2 * (1 - studentTCDF(math.Abs(res.Statistic), res.DF))
+	res.Significant = res.PValue < 1-confidence
+
+	t := studentTQuantile(1-(1-confidence)/2, res.DF)
+	return res, Interval{Low: diff - t*se, High: diff + t*se}
+}
@@ -0,0 +1,99 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+)
+
+func near(t *testing.T, name string, got, want, tol float64) {
+	t.Helper()
+	if math.Abs(got-want) > tol {
+		t.Errorf("%s = %.6f, want %.6f", name, got, want)
+	}
+}
+
+func TestNormal(t *testing.T) {
+	tests := []struct{ z, p float64 }{
+		{0, 0.5},
+		{1, 0.841345},
+		{1.959964, 0.975},
+		{-2.575829, 0.005},
+	}
+	for _, tt := range tests {
+		near(t, "normalCDF", normalCDF(tt.z), tt.p, 1e-6)
+		near(t, "normalQuantile", normalQuantile(tt.p), tt.z, 1e-5)
+	}
+}
+
+// Reference values from standard t tables
+func TestStudentT(t *testing.T) {
+	tests := []struct{ t, df, p float64 }{
+		{0, 5, 0.5},
+		{2, 10, 0.963306},
+		{-2, 10, 0.036694},
+		{12.706205, 1, 0.975},
+		{2.228139, 10, 0.975},
+		{2.042272, 30, 0.975},
+		{-2.845340, 20, 0.005},
+	}
+	for _, tt := range tests {
+		near(t, "studentTCDF", studentTCDF(tt.t, tt.df), tt.p, 1e-5)
+		near(t, "studentTQuantile", studentTQuantile(tt.p, tt.df), tt.t, 1e-4)
+	}
+
+	// With infinite degrees of freedom t is the standard normal
+	near(t, "studentTCDF(inf)", studentTCDF(1.959964, math.Inf(1)), 0.975, 1e-6)
+}
+
+func TestTwoProportionZTest(t *testing.T) {
+	res, ci := twoProportionZTest(120, 1000, 100, 1000, 0.95)
+	near(t, "z", res.Statistic, 1.429301, 1e-5)
+	near(t, "p", res.PValue, 0.152919, 1e-5)
+	near(t, "ci.low", ci.Low, -0.007411, 1e-5)
+	near(t, "ci.high", ci.High, 0.047411, 1e-5)
+	if res.Significant {
+		t.Error("a 2 point difference on 1000 users each should not be significant at 95%")
+	}
+
+	res, _ = twoProportionZTest(200, 1000, 100, 1000, 0.95)
+	if !res.Significant {
+		t.Errorf("20%% vs 10%% on 1000 users each should be significant, p = %f", res.PValue)
+	}
+
+	res, ci = twoProportionZTest(0, 0, 10, 100, 0.95)
+	if res.PValue != 1 || ci != (Interval{}) {
+		t.Errorf("empty treatment: got %+v %+v", res, ci)
+	}
+}
+
+func TestWelchTTest(t *testing.T) {
+	// Equal variances and sizes: df is 2n-2 and t is the mean difference
+	// over sqrt(2*var/n)
+	res, ci := welchTTest(10.5, 1, 50, 10, 1, 50, 0.95)
+	near(t, "t", res.Statistic, 2.5, 1e-9)
+	near(t, "df", res.DF, 98, 1e-9)
+	near(t, "p", res.PValue, 0.014087, 1e-4)
+	if !res.Significant {
+		t.Error("t = 2.5 with 98 df should be significant at 95%")
+	}
+	// The interval's half width is the critical t times the standard error
+	tCrit := studentTQuantile(0.975, 98)
+	near(t, "ci.low", ci.Low, 0.5-tCrit*0.2, 1e-9)
+	near(t, "ci.high", ci.High, 0.5+tCrit*0.2, 1e-9)
+
+	// Unequal variances shrink df below n1+n2-2
+	res, _ = welchTTest(12, 9, 20, 10, 1, 40, 0.95)
+	if res.DF >= 58 || res.DF < 19 {
+		t.Errorf("df = %f, want between min(n)-1 and n1+n2-2", res.DF)
+	}
+
+	res, ci = welchTTest(5, 0, 10, 5, 0, 10, 0.95)
+	if res.PValue != 1 || ci != (Interval{}) {
+		t.Errorf("no variance: got %+v %+v", res, ci)
+	}
+
+	res, _ = welchTTest(5, 1, 1, 4, 1, 10, 0.95)
+	if res.PValue != 1 {
+		t.Errorf("single user: p = %f, want 1", res.PValue)
+	}
+}
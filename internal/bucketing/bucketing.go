@@ -0,0 +1,167 @@
+// Package bucketing assigns users to experiment variants.
+//
+// Assignment is a pure function of (user_id, experiment key, salt), so the
+// API, the worker and the cron all put a user in the same variant without
+// sharing any state.
+package bucketing
+
+import (
+	"errors"
+	"fmt"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Buckets is the resolution of the traffic split: one bucket is 0.01%.
+const Buckets = 10000
+
+// bucketsPerPercent converts variant weights (percent) into buckets
+const bucketsPerPercent = Buckets / 100
+
+// DefaultVariant is reported for experiments that have no variants, where
+// everyone in the segment gets the experiment payload.
+const DefaultVariant = "default"
+
+// Bucket maps a user onto [0, Buckets) for the given experiment.
+func Bucket(userID, experimentKey, salt string) int {
+	return int(xxhash.Sum64String(salt+":"+experimentKey+":"+userID) % Buckets)
+}
+
+// Assign returns the variant the user falls into, or false when the user's
+// bucket lies outside every variant (weights summing to less than 100).
+//
+// Each variant owns the buckets Allocate gave it. Experiments saved before
+// variants had buckets split the buckets into contiguous ranges in the
+// order the variants are declared, which is what Allocate starts from.
+func Assign(userID string, e domain.Experiment) (domain.Variant, bool) {
+	if len(e.Variants) == 0 {
+		return domain.Variant{Key: DefaultVariant, Weight: 100, Payload: e.Payload}, true
+	}
+
+	bucket := Bucket(userID, e.Key, e.Salt)
+	if !allocated(e.Variants) {
+		upper := 0
+		for _, v := range e.Variants {
+			upper += v.Weight * bucketsPerPercent
+			if bucket < upper {
+				return v, true
+			}
+		}
+		return domain.Variant{}, false
+	}
+	for _, v := range e.Variants {
+		for _, r := range v.Buckets {
+			if bucket >= r.From && bucket < r.To {
+				return v, true
+			}
+		}
+	}
+	return domain.Variant{}, false
+}
+
+// Allocate gives each of the next variants the buckets its weight calls
+// for, moving as few buckets as possible from the previous allocation.
+// A variant that shrinks gives up its highest buckets, and one that grows,
+// or is new, takes the lowest buckets nobody owns, so a weight change only
+// moves the users of the weight difference; every other variant keeps its
+// users. Variants are matched by key. previous is nil for a new experiment.
+// The variants must have passed ValidateVariants.
+func Allocate(previous, next []domain.Variant) []domain.Variant {
+	if len(previous) > 0 && !allocated(previous) {
+		previous = Allocate(nil, previous)
+	}
+
+	// owner[b] is the index into next of the variant owning bucket b, or -1
+	owner := make([]int, Buckets)
+	for b := range owner {
+		owner[b] = -1
+	}
+	index := make(map[string]int, len(next))
+	for i, v := range next {
+		index[v.Key] = i
+	}
+	for _, v := range previous {
+		i, ok := index[v.Key]
+		if !ok {
+			continue
+		}
+		kept := 0
+		for _, r := range v.Buckets {
+			for b := r.From; b < r.To && kept < next[i].Weight*bucketsPerPercent; b++ {
+				owner[b] = i
+				kept++
+			}
+		}
+	}
+
+	owned := make([]int, len(next))
+	for _, i := range owner {
+		if i >= 0 {
+			owned[i]++
+		}
+	}
+	free := 0
+	for i, v := range next {
+		for owned[i] < v.Weight*bucketsPerPercent {
+			for owner[free] >= 0 {
+				free++
+			}
+			owner[free] = i
+			owned[i]++
+		}
+	}
+
+	result := make([]domain.Variant, len(next))
+	for i, v := range next {
+		v.Buckets = nil
+		result[i] = v
+	}
+	for b := 0; b < Buckets; b++ {
+		i := owner[b]
+		if i < 0 {
+			continue
+		}
+		ranges := result[i].Buckets
+		if n := len(ranges); n > 0 && ranges[n-1].To == b {
+			ranges[n-1].To++
+		} else {
+			result[i].Buckets = append(ranges, domain.BucketRange{From: b, To: b + 1})
+		}
+	}
+	return result
+}
+
+// allocated reports whether the variants were saved with their buckets
+func allocated(variants []domain.Variant) bool {
+	for _, v := range variants {
+		if len(v.Buckets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateVariants checks variant keys and weights before they are stored.
+func ValidateVariants(variants []domain.Variant) error {
+	total := 0
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if v.Key == "" {
+			return errors.New("every variant needs a key")
+		}
+		if seen[v.Key] {
+			return fmt.Errorf("duplicate variant key %q", v.Key)
+		}
+		seen[v.Key] = true
+		if v.Weight < 0 || v.Weight > 100 {
+			return fmt.Errorf("variant %q weight must be between 0 and 100", v.Key)
+		}
+		total += v.Weight
+	}
+	if len(variants) > 0 && (total == 0 || total > 100) {
+		return fmt.Errorf("variant weights must sum to between 1 and 100, got %d", total)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package bucketing
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+const testUsers = 100000
+
+func variants(weights ...int) []domain.Variant {
+	vs := make([]domain.Variant, len(weights))
+	for i, w := range weights {
+		vs[i] = domain.Variant{Key: string(rune('A' + i)), Weight: w}
+	}
+	return vs
+}
+
+// assignAll returns each test user's variant key, "" when excluded
+func assignAll(e domain.Experiment) []string {
+	keys := make([]string, testUsers)
+	for i := range keys {
+		if v, ok := Assign(fmt.Sprintf("user-%d", i), e); ok {
+			keys[i] = v.Key
+		}
+	}
+	return keys
+}
+
+func TestAllocateGivesEachVariantItsWeight(t *testing.T) {
+	for _, weights := range [][]int{{50, 50}, {33, 33, 33}, {10, 0, 25}, {100}} {
+		seen := make(map[int]bool)
+		for _, v := range Allocate(nil, variants(weights...)) {
+			n := 0
+			for _, r := range v.Buckets {
+				for b := r.From; b < r.To; b++ {
+					if seen[b] {
+						t.Fatalf("%v: bucket %d owned twice", weights, b)
+					}
+					seen[b] = true
+					n++
+				}
+			}
+			if n != v.Weight*bucketsPerPercent {
+				t.Errorf("%v: variant %s owns %d buckets, want %d", weights, v.Key, n, v.Weight*bucketsPerPercent)
+			}
+		}
+	}
+}
+
+func TestAllocateMatchesLegacyContiguousRanges(t *testing.T) {
+	legacy := domain.Experiment{Key: "exp", Salt: "s", Variants: variants(20, 30, 40)}
+	allocated := legacy
+	allocated.Variants = Allocate(nil, legacy.Variants)
+
+	before, after := assignAll(legacy), assignAll(allocated)
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("user-%d moved from %q to %q", i, before[i], after[i])
+		}
+	}
+}
+
+func TestWeightChangeMovesOnlyTheDifference(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []int
+		after  []int
+		// moved is the share of users expected to change variant
+		moved float64
+	}{
+		{"shrink first", []int{33, 33, 33}, []int{20, 33, 33}, 0.13},
+		{"grow first", []int{20, 33, 33}, []int{33, 33, 33}, 0.13},
+		{"shift between", []int{50, 50}, []int{40, 60}, 0.10},
+		{"add variant", []int{50, 40}, []int{50, 40, 10}, 0.10},
+		{"unchanged", []int{25, 25, 25, 25}, []int{25, 25, 25, 25}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := domain.Experiment{Key: "exp", Salt: "s", Variants: Allocate(nil, variants(tt.before...))}
+			before := assignAll(e)
+			e.Variants = Allocate(e.Variants, variants(tt.after...))
+			after := assignAll(e)
+
+			moved := 0
+			for i := range before {
+				if before[i] != after[i] {
+					moved++
+					// Only variants whose weight changed may lose users
+					if k := before[i]; k != "" && tt.before[k[0]-'A'] <= tt.after[k[0]-'A'] {
+						t.Fatalf("user-%d left %s, whose weight did not shrink", i, k)
+					}
+				}
+			}
+			share := float64(moved) / testUsers
+			if math.Abs(share-tt.moved) > 0.01 {
+				t.Errorf("%.2f%% of users moved, want about %.0f%%", share*100, tt.moved*100)
+			}
+		})
+	}
+}
+
+func TestValidateVariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []domain.Variant
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"split", variants(50, 50), false},
+		{"partial", variants(10, 10), false},
+		{"over 100", variants(60, 50), true},
+		{"all zero", variants(0, 0), true},
+		{"negative", variants(-1, 50), true},
+		{"missing key", []domain.Variant{{Weight: 50}}, true},
+		{"duplicate key", []domain.Variant{{Key: "A", Weight: 10}, {Key: "A", Weight: 10}}, true},
+	}
+	for _, tt := range tests {
+		if err := ValidateVariants(tt.in); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,30 +2,223 @@ package domain
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
 	"time"
 )
 
 // UserMetrics represents the aggregated state of a user.
 type UserMetrics struct {
-	UserID       string    `json:"user_id" db:"user_id"`
-	OrderCount   int       `json:"order_count" db:"order_count_total"`
-	Orders23d    int       `json:"orders_23d" db:"orders_23d"`
-	LastOrderAt  time.Time `json:"last_order_at" db:"last_order_at"`
-	LocationTag  string    `json:"location" db:"location_tag"`
-	LTV          float64   `json:"ltv" db:"ltv"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	UserID      string    `json:"user_id" db:"user_id"`
+	OrderCount  int       `json:"order_count" db:"order_count_total"`
+	Orders23d   int       `json:"orders_23d" db:"orders_23d"`
+	LastOrderAt time.Time `json:"last_order_at" db:"last_order_at"` // zero if the user never ordered
+	LocationTag string    `json:"location" db:"location_tag"`
+	TotalSpend  float64   `json:"total_spend" db:"total_spend"`
+	LTV         float64   `json:"ltv" db:"ltv"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	DataVersion int64     `json:"-" db:"data_version"` // bumped on every change to the user's data
+}
+
+// AttributeType is the declared type of a custom user attribute
+type AttributeType string
+
+const (
+	AttrString    AttributeType = "string"
+	AttrNumber    AttributeType = "number"
+	AttrBoolean   AttributeType = "boolean"
+	AttrTimestamp AttributeType = "timestamp" // RFC 3339 string
+)
+
+// UserAttribute is a typed key/value property used for targeting,
+// e.g. platform=ios or signup_date=2024-01-31T00:00:00Z.
+type UserAttribute struct {
+	Key       string        `json:"key"`
+	Type      AttributeType `json:"type"`
+	Value     interface{}   `json:"value"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// Validate checks the key and that Value matches Type. JSON numbers decode
+// as float64, so that is what number attributes hold.
+func (a UserAttribute) Validate() error {
+	if !attributeKeyPattern.MatchString(a.Key) {
+		return fmt.Errorf("attribute key %q must be lower_snake_case", a.Key)
+	}
+
+	var ok bool
+	switch a.Type {
+	case AttrString:
+		_, ok = a.Value.(string)
+	case AttrNumber:
+		_, ok = a.Value.(float64)
+	case AttrBoolean:
+		_, ok = a.Value.(bool)
+	case AttrTimestamp:
+		var s string
+		if s, ok = a.Value.(string); ok {
+			_, err := time.Parse(time.RFC3339, s)
+			ok = err == nil
+		}
+	default:
+		return fmt.Errorf("attribute %q has unknown type %q", a.Key, a.Type)
+	}
+	if !ok {
+		return fmt.Errorf("attribute %q value does not match type %s", a.Key, a.Type)
+	}
+	return nil
+}
+
+// AttributeEvent is the Kafka message that sets attributes for a user
+type AttributeEvent struct {
+	UserID      string          `json:"user_id"`
+	Attributes  []UserAttribute `json:"attributes"`
+	InstantSync bool            `json:"instant_sync"`
 }
 
 // Segment defines David's rules.
 type Segment struct {
 	ID        string          `json:"id"`
 	Name      string          `json:"name"`
-	RuleLogic json.RawMessage `json:"rule_logic"` // JSON-Logic format
+	RuleLogic json.RawMessage `json:"rule_logic"`         // JSON-Logic format
+	RuleDSL   string          `json:"rule_dsl,omitempty"` // rule_logic in the rule DSL; derived, not stored
+	IsActive  bool            `json:"is_active"`
+	Version   int             `json:"version"` // latest SegmentVersion
+	// The segment is only evaluated inside [StartsAt, EndsAt); nil leaves
+	// that side open
+	StartsAt  *time.Time `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// LiveAt reports whether the segment is active and inside its window
+func (s Segment) LiveAt(now time.Time) bool {
+	return s.IsActive && InWindow(s.StartsAt, s.EndsAt, now)
+}
+
+// InWindow reports whether now falls in [starts, ends); a nil bound is open
+func InWindow(starts, ends *time.Time, now time.Time) bool {
+	if starts != nil && now.Before(*starts) {
+		return false
+	}
+	return ends == nil || now.Before(*ends)
+}
+
+// ValidateWindow rejects a window that ends before it starts
+func ValidateWindow(starts, ends *time.Time) error {
+	if starts != nil && ends != nil && !ends.After(*starts) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// SegmentVersion is an immutable snapshot of a segment and its experiments,
+// recorded on every change.
+type SegmentVersion struct {
+	SegmentID   string          `json:"segment_id"`
+	Version     int             `json:"version"`
+	Name        string          `json:"name"`
+	RuleLogic   json.RawMessage `json:"rule_logic"`
+	IsActive    bool            `json:"is_active"`
+	StartsAt    *time.Time      `json:"starts_at"`
+	EndsAt      *time.Time      `json:"ends_at"`
+	Experiments []Experiment    `json:"experiments"`
+	Author      string          `json:"author"`
+	Change      string          `json:"change"` // e.g. "updated", "experiment_created", "rolled_back to v3"
+	Diff        []FieldChange   `json:"diff"`   // against the previous version
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// FieldChange is one difference between two segment versions. Field is
+// e.g. "rule_logic" or "experiments.home_banner.priority"; From is null for
+// additions and To is null for removals.
+type FieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
 }
 
 // Experiment defines what the user gets.
 type Experiment struct {
-	SegmentID string          `json:"segment_id"`
-	Key       string          `json:"key"` // e.g., "banners"
-	Payload   json.RawMessage `json:"payload"`
-}
\ No newline at end of file
+	ID          string          `json:"id"`
+	SegmentID   string          `json:"segment_id"`
+	SegmentName string          `json:"segment_name"`
+	Key         string          `json:"key"`      // e.g., "banners"
+	Payload     json.RawMessage `json:"payload"`  // stored as variant_data, a JSON object of feature keys
+	Variants    []Variant       `json:"variants"` // empty means everyone in the segment gets Payload
+	Salt        string          `json:"salt"`     // change it to reshuffle every user's bucket
+	Priority    int             `json:"priority"` // higher wins when segments set the same feature key
+	StartsAt    *time.Time      `json:"starts_at"`
+	EndsAt      *time.Time      `json:"ends_at"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Variant is one arm of an A/B/n experiment. Weight is the percentage of
+// the segment assigned to it; weights may sum to less than 100, in which case
+// the remaining users are left out of the experiment.
+type Variant struct {
+	Key     string          `json:"key"` // e.g., "control", "treatment"
+	Weight  int             `json:"weight"`
+	Payload json.RawMessage `json:"payload"`
+	// Buckets are the bucket ranges the variant owns, set by
+	// bucketing.Allocate when the experiment is saved; clients don't set them
+	Buckets []BucketRange `json:"buckets,omitempty"`
+}
+
+// BucketRange is the half-open range of buckets [From, To)
+type BucketRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// MergeStrategy decides how a feature key is combined when several
+// matched experiments set it.
+type MergeStrategy string
+
+const (
+	// MergeHighestPriority keeps the value from the highest priority experiment.
+	MergeHighestPriority MergeStrategy = "priority"
+	// MergeDeepMerge merges object values key by key; higher priority wins on conflicts.
+	MergeDeepMerge MergeStrategy = "deep_merge"
+	// MergeUnion concatenates array values, dropping duplicates.
+	MergeUnion MergeStrategy = "union"
+)
+
+// Valid reports whether s is a known strategy.
+func (s MergeStrategy) Valid() bool {
+	switch s {
+	case MergeHighestPriority, MergeDeepMerge, MergeUnion:
+		return true
+	}
+	return false
+}
+
+// ExposureEvent records that a user was served an experiment variant.
+// It is what the results analysis counts as "in the experiment".
+type ExposureEvent struct {
+	UserID        string    `json:"user_id"`
+	ExperimentID  string    `json:"experiment_id"`
+	ExperimentKey string    `json:"experiment_key"`
+	Variant       string    `json:"variant"`
+	SegmentID     string    `json:"segment_id"`
+	SegmentName   string    `json:"segment_name"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// AuditEntry records one mutating API call: who did what to which
+// resource, and the resource before and after when the handler knows it.
+type AuditEntry struct {
+	ID           int64           `json:"id"`
+	OccurredAt   time.Time       `json:"occurred_at"`
+	Actor        string          `json:"actor"`
+	Action       string          `json:"action"`
+	ResourceType string          `json:"resource_type"`
+	ResourceID   string          `json:"resource_id"`
+	RequestID    string          `json:"request_id"`
+	Status       int             `json:"status"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+}
@@ -0,0 +1,86 @@
+// Package exposure publishes experiment exposure events to Kafka.
+package exposure
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// Logger writes one exposure per user, experiment and variant per dedup
+// window.
+// Dedup state lives in Redis so every API instance shares it.
+type Logger struct {
+	writer *kafka.Writer
+	rdb    *redis.Client
+	window time.Duration
+}
+
+func NewLogger(writer *kafka.Writer, rdb *redis.Client, window time.Duration) *Logger {
+	return &Logger{writer: writer, rdb: rdb, window: window}
+}
+
+// dedupKey includes the variant so a user moved to another variant by a
+// weight edit is exposed to it straight away, not after the window
+func dedupKey(e domain.ExposureEvent) string {
+	return "exposure:seen:" + e.UserID + ":" + e.ExperimentID + ":" + e.Variant
+}
+
+// Log publishes the events that haven't been seen within the window and
+// returns how many were sent. A zero window disables dedup.
+func (l *Logger) Log(ctx context.Context, events []domain.ExposureEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	fresh := events
+	if l.window > 0 {
+		// SETNX claims the (user, experiment, variant) for the window; only
+		// the first request inside it gets to publish.
+		pipe := l.rdb.Pipeline()
+		claims := make([]*redis.BoolCmd, len(events))
+		for i, e := range events {
+			claims[i] = pipe.SetNX(ctx, dedupKey(e), e.Variant, l.window)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+
+		fresh = make([]domain.ExposureEvent, 0, len(events))
+		for i, e := range events {
+			if claims[i].Val() {
+				fresh = append(fresh, e)
+			}
+		}
+	}
+	if len(fresh) == 0 {
+		return 0, nil
+	}
+
+	msgs := make([]kafka.Message, 0, len(fresh))
+	for _, e := range fresh {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(e.UserID), Value: value})
+	}
+
+	if err := l.writer.WriteMessages(ctx, msgs...); err != nil {
+		// Release the claims so the next request retries the exposure
+		keys := make([]string, len(fresh))
+		for i, e := range fresh {
+			keys[i] = dedupKey(e)
+		}
+		if l.window > 0 {
+			l.rdb.Del(ctx, keys...)
+		}
+		return 0, err
+	}
+	return len(fresh), nil
+}
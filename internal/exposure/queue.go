@@ -0,0 +1,96 @@
+package exposure
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// publishTimeout bounds one Log call made by a queue worker
+const publishTimeout = 5 * time.Second
+
+// Queue publishes exposures off the request path with a fixed number of
+// workers. When the buffer is full, e.g. while Kafka is down, new events
+// are dropped rather than piling up; they were not claimed for dedup, so
+// the user's next request logs them again.
+type Queue struct {
+	logger *Logger
+	events chan []domain.ExposureEvent
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewQueue starts workers publishing through logger from a buffer of size
+// requests' worth of events
+func NewQueue(logger *Logger, size, workers int) *Queue {
+	q := &Queue{logger: logger, events: make(chan []domain.ExposureEvent, size)}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue hands one request's exposures to the workers without waiting. It
+// returns false if the buffer was full, or the queue closed, and they were
+// dropped.
+func (q *Queue) Enqueue(events []domain.ExposureEvent) bool {
+	if len(events) == 0 {
+		return true
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.events <- events:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting events and waits for the workers to publish what
+// is buffered, or for ctx to end
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for events := range q.events {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		n, err := q.logger.Log(ctx, events)
+		cancel()
+		if err != nil {
+			log.Printf("Exposure Log Error: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("📣 Logged %d exposures for %s", n, events[0].UserID)
+		}
+	}
+}
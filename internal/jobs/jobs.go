@@ -0,0 +1,253 @@
+// Package jobs runs long background work, such as re-evaluating users, and
+// keeps its status in Redis so any API instance can report on it. Its locks
+// keep the same work from running in two places at once.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotFound is returned for unknown or expired jobs
+var ErrNotFound = errors.New("job not found")
+
+// ErrSuperseded is the cause a job's context is cancelled with when a newer
+// job for the same target started; see Store.Supersede
+var ErrSuperseded = errors.New("superseded by a newer job")
+
+// State is where a job is in its life
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Job is the status of one background job as stored in Redis
+type Job struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`             // e.g. "segment_evaluation"
+	Target string `json:"target,omitempty"` // what the job works on, e.g. a segment ID
+	State  State  `json:"state"`
+	// Processed counts units of work done out of Total; Total is 0 while
+	// unknown
+	Processed int64            `json:"processed"`
+	Total     int64            `json:"total"`
+	Counts    map[string]int64 `json:"counts"` // kind-specific tallies, e.g. "added"
+	Errors    int64            `json:"errors"` // units of work that failed without stopping the job
+	Error     string           `json:"error,omitempty"`
+	// Result is what the job reported when it finished, e.g. its stats
+	Result json.RawMessage `json:"result,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+const (
+	keyPrefix = "job:"
+	// retention is how long a job's status can be read after it was last updated
+	retention = 7 * 24 * time.Hour
+	// saveInterval is how often a running job writes its progress
+	saveInterval = time.Second
+	// supersedeInterval is how often a job checks whether it was superseded
+	supersedeInterval = time.Second
+)
+
+// Store creates, runs and looks up jobs
+type Store struct {
+	rdb *redis.Client
+}
+
+func NewStore(rdb *redis.Client) *Store {
+	return &Store{rdb: rdb}
+}
+
+// NewJob returns a queued job that is not stored yet, for callers that
+// need its ID before creating it
+func NewJob(kind, target string) *Job {
+	return &Job{
+		ID:        newID(),
+		Kind:      kind,
+		Target:    target,
+		State:     StateQueued,
+		Counts:    map[string]int64{},
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Create stores a new job so it can be looked up before it starts
+func (s *Store) Create(ctx context.Context, job *Job) error {
+	return s.save(ctx, job)
+}
+
+func (s *Store) Get(ctx context.Context, id string) (*Job, error) {
+	raw, err := s.rdb.Get(ctx, keyPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(raw, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *Store) save(ctx context.Context, job *Job) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, keyPrefix+job.ID, raw, retention).Err()
+}
+
+// Supersede records job as the latest of its kind for its target, and
+// returns a context derived from ctx that is cancelled with cause
+// ErrSuperseded once a later job for the same target calls Supersede, in
+// this process or any other. Call cancel when the job is done.
+func (s *Store) Supersede(ctx context.Context, job *Job) (context.Context, context.CancelFunc, error) {
+	key := keyPrefix + "latest:" + job.Kind + ":" + job.Target
+	if err := s.rdb.Set(ctx, key, job.ID, retention).Err(); err != nil {
+		return nil, nil, err
+	}
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(supersedeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				// A failed check is retried on the next tick
+				latest, err := s.rdb.Get(jobCtx, key).Result()
+				if err == nil && latest != job.ID {
+					cancel(ErrSuperseded)
+					return
+				}
+			}
+		}
+	}()
+	return jobCtx, func() { cancel(nil) }, nil
+}
+
+// Start runs fn in the background as the given job. fn reports progress
+// through the Tracker; its error, if any, fails the job, and cancelling
+// ctx cancels it.
+func (s *Store) Start(ctx context.Context, job *Job, fn func(ctx context.Context, t *Tracker) error) {
+	t := &Tracker{store: s, job: job}
+	go t.run(ctx, fn)
+}
+
+// Tracker is a running job's handle on its status. Its methods are safe to
+// call from several goroutines.
+type Tracker struct {
+	store *Store
+
+	mu        sync.Mutex
+	job       *Job
+	lastSaved time.Time
+}
+
+func (t *Tracker) run(ctx context.Context, fn func(ctx context.Context, t *Tracker) error) {
+	started := time.Now().UTC()
+	t.update(func(j *Job) {
+		j.State = StateRunning
+		j.StartedAt = &started
+	}, true)
+	log.Printf("🏃 Job %s (%s %s) started", t.job.ID, t.job.Kind, t.job.Target)
+
+	err := fn(ctx, t)
+
+	finished := time.Now().UTC()
+	t.update(func(j *Job) {
+		j.FinishedAt = &finished
+		switch {
+		case err == nil:
+			j.State = StateSucceeded
+		case errors.Is(err, context.Canceled):
+			j.State = StateCancelled
+		default:
+			j.State = StateFailed
+			j.Error = err.Error()
+		}
+	}, true)
+	log.Printf("🏁 Job %s (%s %s) %s after %s", t.job.ID, t.job.Kind, t.job.Target, t.job.State, finished.Sub(started).Round(time.Millisecond))
+}
+
+// SetTotal sets how many units of work the job has, once it is known
+func (t *Tracker) SetTotal(total int64) {
+	t.update(func(j *Job) { j.Total = total }, true)
+}
+
+// Progress adds units of work done, failed units among them, and named
+// tallies. Progress is written to Redis at most every saveInterval.
+func (t *Tracker) Progress(processed, failed int64, counts map[string]int64) {
+	t.update(func(j *Job) {
+		j.Processed += processed
+		j.Errors += failed
+		for k, v := range counts {
+			j.Counts[k] += v
+		}
+	}, false)
+}
+
+// SetProgress replaces the job's progress with running totals, for work
+// that keeps its own. Like Progress, it is written at most every
+// saveInterval.
+func (t *Tracker) SetProgress(processed, failed int64, counts map[string]int64) {
+	t.update(func(j *Job) {
+		j.Processed, j.Errors = processed, failed
+		for k, v := range counts {
+			j.Counts[k] = v
+		}
+	}, false)
+}
+
+// SetResult records what the job produced, e.g. its final stats
+func (t *Tracker) SetResult(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.update(func(j *Job) { j.Result = raw }, true)
+	return nil
+}
+
+// update changes the job and saves it when forced or when the last save
+// is old enough. Saves use their own context so a cancelled job can still
+// record that it was cancelled.
+func (t *Tracker) update(fn func(*Job), force bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(t.job)
+	if !force && time.Since(t.lastSaved) < saveInterval {
+		return
+	}
+	t.lastSaved = time.Now()
+	if err := t.store.save(context.Background(), t.job); err != nil {
+		log.Printf("❌ Failed to save job %s: %v", t.job.ID, err)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,45 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSupersede(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := testRedis(t)
+	store := NewStore(rdb)
+
+	first := NewJob("segment_evaluation", "s1")
+	firstCtx, cancelFirst, err := store.Supersede(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelFirst()
+
+	// A job for another target leaves it running
+	other := NewJob("segment_evaluation", "s2")
+	otherCtx, cancelOther, err := store.Supersede(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelOther()
+
+	second := NewJob("segment_evaluation", "s1")
+	secondCtx, cancelSecond, err := store.Supersede(ctx, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelSecond()
+
+	if cause := cancelled(t, firstCtx); !errors.Is(cause, ErrSuperseded) {
+		t.Errorf("cause = %v, want ErrSuperseded", cause)
+	}
+	if err := secondCtx.Err(); err != nil {
+		t.Errorf("latest job's context: %v", err)
+	}
+	if err := otherCtx.Err(); err != nil {
+		t.Errorf("other target's context: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrLocked is returned by Acquire when someone else holds the lock
+	ErrLocked = errors.New("lock is held by another process")
+	// ErrLockLost is the cause a Lock's context is cancelled with when the
+	// lock expired or was taken over before it could be refreshed
+	ErrLockLost = errors.New("lock was lost")
+)
+
+// Only the holder may refresh or release a lock, so both check the owner
+// and act in one step
+var (
+	refreshScript = redis.NewScript(`
+        if redis.call("GET", KEYS[1]) == ARGV[1] then
+            return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+        end
+        return 0`)
+	releaseScript = redis.NewScript(`
+        if redis.call("GET", KEYS[1]) == ARGV[1] then
+            return redis.call("DEL", KEYS[1])
+        end
+        return 0`)
+)
+
+// Lock is a lock in Redis that keeps one piece of work running on one
+// process at a time, across API instances and cron. It expires after its
+// TTL unless refreshed, which the holder does in the background until
+// Release, so a crashed holder cannot keep it forever.
+type Lock struct {
+	rdb   *redis.Client
+	key   string
+	owner string
+	ttl   time.Duration
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// Acquire takes the lock at key for owner, which must be unique to the
+// caller, e.g. a job ID. It returns ErrLocked if someone else holds it.
+func Acquire(ctx context.Context, rdb *redis.Client, key, owner string, ttl time.Duration) (*Lock, error) {
+	ok, err := rdb.SetNX(ctx, key, owner, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	l := &Lock{rdb: rdb, key: key, owner: owner, ttl: ttl, done: make(chan struct{})}
+	l.ctx, l.cancel = context.WithCancelCause(ctx)
+	go l.keepAlive()
+	return l, nil
+}
+
+// AcquireWait is Acquire for work that should wait its turn rather than be
+// skipped: while someone else holds the lock it tries again every retry,
+// until it gets the lock or ctx is done.
+func AcquireWait(ctx context.Context, rdb *redis.Client, key, owner string, ttl, retry time.Duration) (*Lock, error) {
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	for {
+		l, err := Acquire(ctx, rdb, key, owner, ttl)
+		if !errors.Is(err, ErrLocked) {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Holder returns who holds the lock at key, or "" if nobody does
+func Holder(ctx context.Context, rdb *redis.Client, key string) (string, error) {
+	owner, err := rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, err
+}
+
+// Context is cancelled when the lock is released, or with cause
+// ErrLockLost when it is lost. Work done under the lock should use it.
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+// Release gives the lock up, unless it was already lost
+func (l *Lock) Release() error {
+	l.cancel(nil)
+	<-l.done
+	return releaseScript.Run(context.Background(), l.rdb, []string{l.key}, l.owner).Err()
+}
+
+// keepAlive refreshes the lock every third of its TTL. A refresh that
+// fails is retried on the next tick; one that finds the lock gone or
+// taken over cancels the lock's context.
+func (l *Lock) keepAlive() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := refreshScript.Run(context.WithoutCancel(l.ctx), l.rdb, []string{l.key}, l.owner, l.ttl.Milliseconds()).Int()
+			if err != nil {
+				log.Printf("❌ Failed to refresh lock %s: %v", l.key, err)
+				continue
+			}
+			if held == 0 {
+				log.Printf("⚠️ Lost lock %s", l.key)
+				l.cancel(ErrLockLost)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testKey = "test:lock"
+
+// testRedis starts an in-memory Redis for one test
+func testRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return m, rdb
+}
+
+// cancelled waits for ctx to be done and returns its cause
+func cancelled(t *testing.T, ctx context.Context) error {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context was not cancelled")
+		return nil
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	lock, err := Acquire(ctx, rdb, testKey, "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Acquire(ctx, rdb, testKey, "b", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Acquire: err = %v, want ErrLocked", err)
+	}
+	if holder, _ := Holder(ctx, rdb, testKey); holder != "a" {
+		t.Errorf("Holder = %q, want a", holder)
+	}
+	if ttl := m.TTL(testKey); ttl != time.Minute {
+		t.Errorf("TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Context().Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("context after Release: err = %v, want Canceled", err)
+	}
+	if holder, _ := Holder(ctx, rdb, testKey); holder != "" {
+		t.Errorf("Holder after Release = %q, want none", holder)
+	}
+	if _, err := Acquire(ctx, rdb, testKey, "b", time.Minute); err != nil {
+		t.Errorf("Acquire after Release: %v", err)
+	}
+}
+
+func TestReleaseKeepsSomeoneElsesLock(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	lock, err := Acquire(ctx, rdb, testKey, "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a's lock expired and b took it
+	m.Set(testKey, "b")
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := Holder(ctx, rdb, testKey); holder != "b" {
+		t.Errorf("Holder = %q, want b", holder)
+	}
+}
+
+func TestKeepAliveRefreshesTTL(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	ttl := 150 * time.Millisecond
+	lock, err := Acquire(ctx, rdb, testKey, "a", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	// miniredis only expires keys on FastForward, so shorten the TTL by
+	// hand and wait for a refresh to restore it
+	m.SetTTL(testKey, time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for m.TTL(testKey) != ttl {
+		if time.Now().After(deadline) {
+			t.Fatalf("TTL = %v, not refreshed to %v", m.TTL(testKey), ttl)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lock.Context().Err(); err != nil {
+		t.Errorf("context of a held lock: %v", err)
+	}
+}
+
+func TestKeepAliveLosesLock(t *testing.T) {
+	tests := []struct {
+		name string
+		lose func(m *miniredis.Miniredis)
+	}{
+		{"expired", func(m *miniredis.Miniredis) { m.FastForward(time.Minute) }},
+		{"taken over", func(m *miniredis.Miniredis) { m.Set(testKey, "b") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rdb := testRedis(t)
+			lock, err := Acquire(context.Background(), rdb, testKey, "a", 150*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.lose(m)
+
+			if cause := cancelled(t, lock.Context()); !errors.Is(cause, ErrLockLost) {
+				t.Errorf("cause = %v, want ErrLockLost", cause)
+			}
+			if err := lock.Release(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKeepAliveSurvivesRedisErrors(t *testing.T) {
+	m, rdb := testRedis(t)
+	lock, err := Acquire(context.Background(), rdb, testKey, "a", 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	// Failed refreshes are retried rather than giving the lock up
+	m.SetError("unavailable")
+	time.Sleep(200 * time.Millisecond)
+	if err := lock.Context().Err(); err != nil {
+		t.Fatalf("context after failed refreshes: %v", err)
+	}
+
+	m.SetError("")
+	m.Set(testKey, "b")
+	if cause := cancelled(t, lock.Context()); !errors.Is(cause, ErrLockLost) {
+		t.Errorf("cause = %v, want ErrLockLost", cause)
+	}
+}
+
+func TestAcquireWait(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := testRedis(t)
+
+	first, err := Acquire(ctx, rdb, testKey, "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release()
+	}()
+
+	second, err := AcquireWait(ctx, rdb, testKey, "b", time.Minute, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Release()
+	if holder, _ := Holder(ctx, rdb, testKey); holder != "b" {
+		t.Errorf("Holder = %q, want b", holder)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireWait(waitCtx, rdb, testKey, "c", time.Minute, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireWait on a held lock: err = %v, want DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// AttributeRepository defines the operations for custom user attributes
+type AttributeRepository interface {
+	Set(ctx context.Context, userID string, attrs []domain.UserAttribute) error
+	List(ctx context.Context, userID string) ([]domain.UserAttribute, error)
+	ListForUsers(ctx context.Context, userIDs []string) (map[string][]domain.UserAttribute, error)
+	Delete(ctx context.Context, userID, key string) error
+}
+
+type postgresAttributeRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresAttributeRepository(db *sql.DB) AttributeRepository {
+	return &postgresAttributeRepo{db: db}
+}
+
+// Set upserts the given attributes; attributes not listed are left alone.
+// The user is marked dirty for re-evaluation. Callers validate the
+// attributes first.
+func (r *postgresAttributeRepo) Set(ctx context.Context, userID string, attrs []domain.UserAttribute) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO user_attributes (user_id, key, value_type, value, updated_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        ON CONFLICT (user_id, key) DO UPDATE SET
+            value_type = EXCLUDED.value_type,
+            value = EXCLUDED.value,
+            updated_at = NOW()`
+
+	for _, a := range attrs {
+		value, err := json.Marshal(a.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, userID, a.Key, string(a.Type), value); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_metrics SET `+markDirty+` WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *postgresAttributeRepo) List(ctx context.Context, userID string) ([]domain.UserAttribute, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT key, value_type, value, updated_at FROM user_attributes
+        WHERE user_id = $1 ORDER BY key`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attrs := []domain.UserAttribute{}
+	for rows.Next() {
+		a, err := scanAttribute(rows, nil)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, *a)
+	}
+	return attrs, rows.Err()
+}
+
+// ListForUsers loads the attributes of many users in one query, for bulk
+// evaluation. Users without attributes are absent from the map.
+func (r *postgresAttributeRepo) ListForUsers(ctx context.Context, userIDs []string) (map[string][]domain.UserAttribute, error) {
+	byUser := make(map[string][]domain.UserAttribute)
+	if len(userIDs) == 0 {
+		return byUser, nil
+	}
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT user_id, key, value_type, value, updated_at FROM user_attributes
+        WHERE user_id = ANY($1) ORDER BY user_id, key`, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		a, err := scanAttribute(rows, &userID)
+		if err != nil {
+			return nil, err
+		}
+		byUser[userID] = append(byUser[userID], *a)
+	}
+	return byUser, rows.Err()
+}
+
+// scanAttribute reads a row of user_id (unless userID is nil), key,
+// value_type, value and updated_at
+func scanAttribute(row interface{ Scan(...any) error }, userID *string) (*domain.UserAttribute, error) {
+	a := &domain.UserAttribute{}
+	var valueType string
+	var value []byte
+	dest := []any{&a.Key, &valueType, &value, &a.UpdatedAt}
+	if userID != nil {
+		dest = append([]any{userID}, dest...)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	a.Type = domain.AttributeType(valueType)
+	if err := json.Unmarshal(value, &a.Value); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *postgresAttributeRepo) Delete(ctx context.Context, userID, key string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM user_attributes WHERE user_id = $1 AND key = $2`, userID, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	_, err = r.db.ExecContext(ctx, `UPDATE user_metrics SET `+markDirty+` WHERE user_id = $1`, userID)
+	return err
+}
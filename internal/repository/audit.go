@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// AuditFilter narrows an audit log query. Empty fields match everything.
+// Results are newest first; pass the last ID of a page as BeforeID to get
+// the next one.
+type AuditFilter struct {
+	Actor        string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	RequestID    string
+	Since        time.Time
+	Until        time.Time
+	BeforeID     int64
+	Limit        int
+}
+
+// AuditRepository appends to and reads the audit log. There is no update
+// or delete; the table rejects them.
+type AuditRepository interface {
+	Append(ctx context.Context, e *domain.AuditEntry) error
+	List(ctx context.Context, f AuditFilter) ([]domain.AuditEntry, error)
+}
+
+type postgresAuditRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresAuditRepository(db *sql.DB) AuditRepository {
+	return &postgresAuditRepo{db: db}
+}
+
+func (r *postgresAuditRepo) Append(ctx context.Context, e *domain.AuditEntry) error {
+	query := `
+        INSERT INTO audit_log (actor, action, resource_type, resource_id, request_id, status, before, after)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id, occurred_at`
+
+	return r.db.QueryRowContext(ctx, query,
+		e.Actor, e.Action, e.ResourceType, e.ResourceID, e.RequestID, e.Status, nullJSON(e.Before), nullJSON(e.After),
+	).Scan(&e.ID, &e.OccurredAt)
+}
+
+func (r *postgresAuditRepo) List(ctx context.Context, f AuditFilter) ([]domain.AuditEntry, error) {
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if f.Actor != "" {
+		add("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.ResourceType != "" {
+		add("resource_type = ?", f.ResourceType)
+	}
+	if f.ResourceID != "" {
+		add("resource_id = ?", f.ResourceID)
+	}
+	if f.RequestID != "" {
+		add("request_id = ?", f.RequestID)
+	}
+	if !f.Since.IsZero() {
+		add("occurred_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("occurred_at < ?", f.Until)
+	}
+	if f.BeforeID > 0 {
+		add("id < ?", f.BeforeID)
+	}
+
+	query := `
+        SELECT id, occurred_at, actor, action, resource_type, resource_id, request_id, status, before, after
+        FROM audit_log`
+	if len(where) > 0 {
+		query += `
+        WHERE ` + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += `
+        ORDER BY id DESC
+        LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []domain.AuditEntry{}
+	for rows.Next() {
+		var e domain.AuditEntry
+		var before, after []byte
+		err := rows.Scan(&e.ID, &e.OccurredAt, &e.Actor, &e.Action, &e.ResourceType, &e.ResourceID, &e.RequestID, &e.Status, &before, &after)
+		if err != nil {
+			return nil, err
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// nullJSON stores missing JSON as SQL NULL rather than an empty string
+func nullJSON(raw []byte) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return raw
+}
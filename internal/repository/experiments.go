@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// ExperimentRepository defines the operations for segment payloads. Every
+// change records the owning segment's next version, attributed to author.
+type ExperimentRepository interface {
+	Create(ctx context.Context, e *domain.Experiment, author string) error
+	ListBySegment(ctx context.Context, segmentID string) ([]domain.Experiment, error)
+	ListForSegmentIDs(ctx context.Context, ids []string) ([]domain.Experiment, error)
+	Get(ctx context.Context, id string) (*domain.Experiment, error)
+	Update(ctx context.Context, e *domain.Experiment, author string) error
+	Delete(ctx context.Context, id, author string) error
+}
+
+type postgresExperimentRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresExperimentRepository(db *sql.DB) ExperimentRepository {
+	return &postgresExperimentRepo{db: db}
+}
+
+// experimentSelect joins the owning segment so callers can explain where a
+// feature value came from without a second lookup.
+const experimentSelect = `
+        SELECT e.id, e.segment_id, s.name, e.experiment_key, e.variant_data, e.variants, e.salt, e.priority, e.starts_at, e.ends_at, e.created_at
+        FROM experiments e
+        JOIN segments s ON s.id = e.segment_id`
+
+// experimentOrder puts the highest priority first; ties go to the oldest row
+const experimentOrder = `
+        ORDER BY e.priority DESC, e.created_at, e.id`
+
+func scanExperiment(row interface{ Scan(...any) error }) (*domain.Experiment, error) {
+	e := &domain.Experiment{}
+	var payload, variants []byte
+	var startsAt, endsAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.SegmentID, &e.SegmentName, &e.Key, &payload, &variants, &e.Salt, &e.Priority, &startsAt, &endsAt, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	e.StartsAt, e.EndsAt = timePtr(startsAt), timePtr(endsAt)
+	e.Payload = payload
+	if err := json.Unmarshal(variants, &e.Variants); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// marshalVariants stores a missing variant list as an empty array, which is
+// what the column default and the bucketing code expect.
+func marshalVariants(variants []domain.Variant) ([]byte, error) {
+	if variants == nil {
+		variants = []domain.Variant{}
+	}
+	return json.Marshal(variants)
+}
+
+func (r *postgresExperimentRepo) query(ctx context.Context, query string, args ...any) ([]domain.Experiment, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	experiments := []domain.Experiment{}
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			return nil, err
+		}
+		experiments = append(experiments, *e)
+	}
+	return experiments, rows.Err()
+}
+
+func (r *postgresExperimentRepo) Create(ctx context.Context, e *domain.Experiment, author string) error {
+	query := `
+        INSERT INTO experiments (segment_id, experiment_key, variant_data, variants, salt, priority, starts_at, ends_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id, created_at, (SELECT name FROM segments WHERE id = $1)`
+
+	variants, err := marshalVariants(e.Variants)
+	if err != nil {
+		return err
+	}
+	_, err = versioned(ctx, r.db, author, "experiment_created", func(tx *sql.Tx) (string, error) {
+		err := tx.QueryRowContext(ctx, query, e.SegmentID, e.Key, []byte(e.Payload), variants, e.Salt, e.Priority, e.StartsAt, e.EndsAt).Scan(&e.ID, &e.CreatedAt, &e.SegmentName)
+		return e.SegmentID, err
+	})
+	return err
+}
+
+func (r *postgresExperimentRepo) ListBySegment(ctx context.Context, segmentID string) ([]domain.Experiment, error) {
+	if !validID(segmentID) {
+		return []domain.Experiment{}, nil
+	}
+	return r.query(ctx, experimentSelect+`
+        WHERE e.segment_id = $1`+experimentOrder, segmentID)
+}
+
+// servingWindow limits a query to experiments that should be served now
+var servingWindow = `s.is_active = true AND ` + windowOpen("s") + ` AND ` + windowOpen("e")
+
+// ListForSegmentIDs returns the experiments attached to the given segments,
+// which is what the Redis membership sets hold. Only experiments of active
+// segments inside their windows, and inside their own, are returned, so a
+// stale cached membership never serves a retired segment.
+func (r *postgresExperimentRepo) ListForSegmentIDs(ctx context.Context, ids []string) ([]domain.Experiment, error) {
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if validID(id) {
+			valid = append(valid, id)
+		}
+	}
+	if len(valid) == 0 {
+		return []domain.Experiment{}, nil
+	}
+	return r.query(ctx, experimentSelect+`
+        WHERE e.segment_id = ANY($1) AND `+servingWindow+experimentOrder, pq.Array(valid))
+}
+
+func (r *postgresExperimentRepo) Get(ctx context.Context, id string) (*domain.Experiment, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	e, err := scanExperiment(r.db.QueryRowContext(ctx, experimentSelect+`
+        WHERE e.id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+func (r *postgresExperimentRepo) Update(ctx context.Context, e *domain.Experiment, author string) error {
+	if !validID(e.ID) {
+		return ErrNotFound
+	}
+	query := `
+        UPDATE experiments SET experiment_key = $2, variant_data = $3, variants = $4, salt = $5, priority = $6, starts_at = $7, ends_at = $8
+        WHERE id = $1
+        RETURNING segment_id, created_at`
+
+	variants, err := marshalVariants(e.Variants)
+	if err != nil {
+		return err
+	}
+	_, err = versioned(ctx, r.db, author, "experiment_updated", func(tx *sql.Tx) (string, error) {
+		err := tx.QueryRowContext(ctx, query, e.ID, e.Key, []byte(e.Payload), variants, e.Salt, e.Priority, e.StartsAt, e.EndsAt).Scan(&e.SegmentID, &e.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+		return e.SegmentID, tx.QueryRowContext(ctx, `SELECT name FROM segments WHERE id = $1`, e.SegmentID).Scan(&e.SegmentName)
+	})
+	return err
+}
+
+func (r *postgresExperimentRepo) Delete(ctx context.Context, id, author string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	_, err := versioned(ctx, r.db, author, "experiment_deleted", func(tx *sql.Tx) (string, error) {
+		var segmentID string
+		err := tx.QueryRowContext(ctx, `DELETE FROM experiments WHERE id = $1 RETURNING segment_id`, id).Scan(&segmentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return segmentID, err
+	})
+	return err
+}
@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// ExposureRepository persists exposure events consumed from Kafka
+type ExposureRepository interface {
+	Record(ctx context.Context, e domain.ExposureEvent) error
+}
+
+type postgresExposureRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresExposureRepository(db *sql.DB) ExposureRepository {
+	return &postgresExposureRepo{db: db}
+}
+
+func (r *postgresExposureRepo) Record(ctx context.Context, e domain.ExposureEvent) error {
+	query := `
+        INSERT INTO experiment_exposures (user_id, experiment_id, experiment_key, variant, segment_id, exposed_at)
+        VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, $6)`
+
+	_, err := r.db.ExecContext(ctx, query, e.UserID, e.ExperimentID, e.ExperimentKey, e.Variant, e.SegmentID, e.Timestamp)
+	return err
+}
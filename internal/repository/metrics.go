@@ -3,23 +3,35 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/lib/pq"
 )
 
-// UserMetrics represents the database structure
-type UserMetrics struct {
-	UserID      string
-	Orders23d   int
-	TotalSpend  float64
-	LocationTag string
-}
+// OrdersWindow is the rolling window behind orders_23d, as a Postgres interval
+const OrdersWindow = "23 days"
 
 // MetricsRepository defines the operations for user data
 type MetricsRepository interface {
 	UpsertOrder(ctx context.Context, userID string, amount float64, location string) error
-	GetMetrics(ctx context.Context, userID string) (*UserMetrics, error)
+	GetMetrics(ctx context.Context, userID string) (*domain.UserMetrics, error)
+	ListPage(ctx context.Context, afterUserID string, limit int) ([]domain.UserMetrics, error)
 	EnsureUser(ctx context.Context, userID string) error
+	DecayRollingCounts(ctx context.Context) ([]string, error)
+	ListDirtyPage(ctx context.Context, afterUserID string, limit int) ([]domain.UserMetrics, error)
+	Count(ctx context.Context, dirtyOnly bool) (int64, error)
+	MarkDirty(ctx context.Context, userIDs []string) error
+	MarkDaysElapsed(ctx context.Context, since, now time.Time) (int64, error)
+	ClearDirty(ctx context.Context, evaluated map[string]int64) error
 }
 
+// markDirty flags a user for the next incremental evaluation, keeping the
+// time of the earliest unprocessed change, and bumps their data_version so
+// an evaluation that read the row before this change leaves them dirty
+const markDirty = `dirty_since = COALESCE(user_metrics.dirty_since, NOW()), data_version = user_metrics.data_version + 1`
+
 type postgresMetricsRepo struct {
 	db *sql.DB
 }
@@ -29,33 +41,213 @@ func NewPostgresMetricsRepository(db *sql.DB) MetricsRepository {
 }
 
 func (r *postgresMetricsRepo) UpsertOrder(ctx context.Context, userID string, amount float64, location string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialise writers for the same user so the recount below sees every
+	// committed event
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, userID); err != nil {
+		return err
+	}
+
+	// Keep the raw event so experiment results can attribute orders
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO order_events (user_id, amount, location_tag) VALUES ($1, $2, $3)`,
+		userID, amount, location)
+	if err != nil {
+		return err
+	}
+
+	// orders_23d is recounted from the events rather than incremented, so
+	// orders that fell out of the window are dropped on every write
+	var orders23d int
+	err = tx.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM order_events
+        WHERE user_id = $1 AND created_at > NOW() - $2::interval`, userID, OrdersWindow).Scan(&orders23d)
+	if err != nil {
+		return err
+	}
+
+	// ltv is lifetime gross spend; total_spend is kept alongside it for the
+	// rules and screens that already read it
 	query := `
-        INSERT INTO user_metrics (user_id, orders_23d, total_spend, location_tag, last_updated)
-        VALUES ($1, 1, $2, $3, NOW())
+        INSERT INTO user_metrics (user_id, order_count_total, orders_23d, last_order_at, total_spend, ltv, location_tag, updated_at, dirty_since)
+        VALUES ($1, 1, $4, NOW(), $2, $2, $3, NOW(), NOW())
         ON CONFLICT (user_id) DO UPDATE SET
-            orders_23d = user_metrics.orders_23d + 1,
+            order_count_total = user_metrics.order_count_total + 1,
+            orders_23d = EXCLUDED.orders_23d,
+            last_order_at = NOW(),
             total_spend = user_metrics.total_spend + EXCLUDED.total_spend,
+            ltv = user_metrics.ltv + EXCLUDED.ltv,
             location_tag = EXCLUDED.location_tag,
-            last_updated = NOW();`
+            updated_at = NOW(),
+            ` + markDirty + `;`
+
+	if _, err := tx.ExecContext(ctx, query, userID, amount, location, orders23d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MetricsColumns lists the user_metrics columns read by ScanMetrics, in order
+const MetricsColumns = `user_id, order_count_total, orders_23d, last_order_at, location_tag, total_spend, ltv, updated_at, data_version`
+
+// ScanMetrics reads one row selected with MetricsColumns
+func ScanMetrics(row interface{ Scan(...any) error }) (*domain.UserMetrics, error) {
+	m := &domain.UserMetrics{}
+	var lastOrderAt, updatedAt sql.NullTime
+	var location sql.NullString
+	err := row.Scan(&m.UserID, &m.OrderCount, &m.Orders23d, &lastOrderAt, &location, &m.TotalSpend, &m.LTV, &updatedAt, &m.DataVersion)
+	if err != nil {
+		return nil, err
+	}
+	m.LastOrderAt = lastOrderAt.Time
+	m.UpdatedAt = updatedAt.Time
+	m.LocationTag = location.String
+	return m, nil
+}
+
+func (r *postgresMetricsRepo) GetMetrics(ctx context.Context, userID string) (*domain.UserMetrics, error) {
+	query := `SELECT ` + MetricsColumns + ` FROM user_metrics WHERE user_id = $1`
+	return ScanMetrics(r.db.QueryRowContext(ctx, query, userID))
+}
+
+// ListPage returns up to limit users in user_id order, starting after
+// afterUserID ("" for the first page). Paging on the primary key keeps every
+// page an index range scan however deep into the table it is.
+func (r *postgresMetricsRepo) ListPage(ctx context.Context, afterUserID string, limit int) ([]domain.UserMetrics, error) {
+	return r.page(ctx, `
+        SELECT `+MetricsColumns+` FROM user_metrics
+        WHERE user_id > $1 ORDER BY user_id LIMIT $2`, afterUserID, limit)
+}
+
+func (r *postgresMetricsRepo) page(ctx context.Context, query string, afterUserID string, limit int) ([]domain.UserMetrics, error) {
+	rows, err := r.db.QueryContext(ctx, query, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]domain.UserMetrics, 0, limit)
+	for rows.Next() {
+		m, err := ScanMetrics(rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, *m)
+	}
+	return page, rows.Err()
+}
+
+// ListDirtyPage is ListPage over the users marked dirty
+func (r *postgresMetricsRepo) ListDirtyPage(ctx context.Context, afterUserID string, limit int) ([]domain.UserMetrics, error) {
+	return r.page(ctx, `
+        SELECT `+MetricsColumns+` FROM user_metrics
+        WHERE dirty_since IS NOT NULL AND user_id > $1 ORDER BY user_id LIMIT $2`, afterUserID, limit)
+}
+
+// Count returns how many users there are, or how many are dirty
+func (r *postgresMetricsRepo) Count(ctx context.Context, dirtyOnly bool) (int64, error) {
+	query := `SELECT COUNT(*) FROM user_metrics`
+	if dirtyOnly {
+		query += ` WHERE dirty_since IS NOT NULL`
+	}
+	var n int64
+	err := r.db.QueryRowContext(ctx, query).Scan(&n)
+	return n, err
+}
 
-	_, err := r.db.ExecContext(ctx, query, userID, amount, location)
+// MarkDirty flags users for the next incremental evaluation, e.g. after
+// their cached segments failed to be written
+func (r *postgresMetricsRepo) MarkDirty(ctx context.Context, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	_, err := r.db.ExecContext(ctx, `UPDATE user_metrics SET `+markDirty+` WHERE user_id = ANY($1)`, pq.Array(userIDs))
 	return err
 }
 
-func (r *postgresMetricsRepo) GetMetrics(ctx context.Context, userID string) (*UserMetrics, error) {
-	m := &UserMetrics{}
-	query := `SELECT user_id, orders_23d, total_spend, location_tag FROM user_metrics WHERE user_id = $1`
-	err := r.db.QueryRowContext(ctx, query, userID).Scan(&m.UserID, &m.Orders23d, &m.TotalSpend, &m.LocationTag)
-	return m, err
+// MarkDaysElapsed flags the users whose days_since_last_order went up
+// between since and now, since that changes without any write to their
+// data. It returns how many were flagged.
+func (r *postgresMetricsRepo) MarkDaysElapsed(ctx context.Context, since, now time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+        UPDATE user_metrics SET `+markDirty+`
+        WHERE last_order_at IS NOT NULL AND dirty_since IS NULL
+          AND floor(extract(epoch FROM $1::timestamptz - last_order_at) / 86400)
+           <> floor(extract(epoch FROM $2::timestamptz - last_order_at) / 86400)`, since, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClearDirty unflags users once they have been re-evaluated, given the
+// data_version of each user's row as the evaluation read it. Users whose
+// data changed since then have a newer version and stay dirty.
+func (r *postgresMetricsRepo) ClearDirty(ctx context.Context, evaluated map[string]int64) error {
+	if len(evaluated) == 0 {
+		return nil
+	}
+	userIDs := make([]string, 0, len(evaluated))
+	versions := make([]int64, 0, len(evaluated))
+	for id, v := range evaluated {
+		userIDs = append(userIDs, id)
+		versions = append(versions, v)
+	}
+	_, err := r.db.ExecContext(ctx, `
+        UPDATE user_metrics m SET dirty_since = NULL
+        FROM unnest($1::text[], $2::bigint[]) AS e(user_id, data_version)
+        WHERE m.user_id = e.user_id AND m.data_version = e.data_version
+          AND m.dirty_since IS NOT NULL`, pq.Array(userIDs), pq.Array(versions))
+	return err
 }
 
 func (r *postgresMetricsRepo) EnsureUser(ctx context.Context, userID string) error {
 	// We initialize with 0 orders and 0 spend
 	query := `
-        INSERT INTO user_metrics (user_id, orders_23d, total_spend, location_tag) 
-        VALUES ($1, 0, 0.0, 'unknown') 
+        INSERT INTO user_metrics (user_id, order_count_total, orders_23d, total_spend, ltv, location_tag, updated_at, dirty_since)
+        VALUES ($1, 0, 0, 0.0, 0.0, 'unknown', NOW(), NOW())
         ON CONFLICT (user_id) DO NOTHING`
 
 	_, err := r.db.ExecContext(ctx, query, userID)
 	return err
 }
+
+// DecayRollingCounts recomputes orders_23d for users who had orders in the
+// window, so users who went quiet drop out of it without placing a new order.
+// It returns the users whose count changed.
+func (r *postgresMetricsRepo) DecayRollingCounts(ctx context.Context) ([]string, error) {
+	query := `
+        WITH fresh AS (
+            SELECT m.user_id,
+                   (SELECT COUNT(*) FROM order_events o
+                    WHERE o.user_id = m.user_id AND o.created_at > NOW() - $1::interval) AS orders
+            FROM user_metrics m
+            WHERE m.orders_23d > 0
+        )
+        UPDATE user_metrics m SET orders_23d = f.orders, updated_at = NOW(),
+            dirty_since = COALESCE(m.dirty_since, NOW()), data_version = m.data_version + 1
+        FROM fresh f
+        WHERE m.user_id = f.user_id AND m.orders_23d <> f.orders
+        RETURNING m.user_id`
+
+	rows, err := r.db.QueryContext(ctx, query, OrdersWindow)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		changed = append(changed, id)
+	}
+	return changed, rows.Err()
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testDB opens a mock database for one test and checks every expectation
+// was met at the end
+func testDB(t *testing.T) (*postgresMetricsRepo, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return &postgresMetricsRepo{db: db}, mock
+}
+
+func TestUpsertOrder(t *testing.T) {
+	repo, mock := testDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock(hashtext($1))`)).
+		WithArgs("U1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO order_events (user_id, amount, location_tag) VALUES ($1, $2, $3)`)).
+		WithArgs("U1", 12.5, "Dhaka").WillReturnResult(sqlmock.NewResult(0, 1))
+	// The recount, not an increment, is what gets stored
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM order_events\s+WHERE user_id = \$1 AND created_at > NOW\(\) - \$2::interval`).
+		WithArgs("U1", OrdersWindow).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectExec(`INSERT INTO user_metrics .* orders_23d = EXCLUDED.orders_23d,.* data_version = user_metrics.data_version \+ 1`).
+		WithArgs("U1", 12.5, "Dhaka", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := repo.UpsertOrder(context.Background(), "U1", 12.5, "Dhaka"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertOrderRollsBackOnError(t *testing.T) {
+	repo, mock := testDB(t)
+	failure := errors.New("connection reset")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs("U1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO order_events`).WithArgs("U1", 12.5, "Dhaka").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM order_events`).WithArgs("U1", OrdersWindow).WillReturnError(failure)
+	mock.ExpectRollback()
+
+	if err := repo.UpsertOrder(context.Background(), "U1", 12.5, "Dhaka"); !errors.Is(err, failure) {
+		t.Errorf("err = %v, want %v", err, failure)
+	}
+}
+
+func TestDecayRollingCounts(t *testing.T) {
+	repo, mock := testDB(t)
+
+	mock.ExpectQuery(`UPDATE user_metrics m SET orders_23d = f.orders,.* data_version = m.data_version \+ 1\s+FROM fresh f\s+WHERE m.user_id = f.user_id AND m.orders_23d <> f.orders\s+RETURNING m.user_id`).
+		WithArgs(OrdersWindow).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("U1").AddRow("U7"))
+
+	changed, err := repo.DecayRollingCounts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"U1", "U7"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+}
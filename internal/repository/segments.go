@@ -0,0 +1,253 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/lib/pq"
+)
+
+// ErrNotFound is returned when the requested row does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a write would break a uniqueness rule, such
+// as two segments sharing a name
+var ErrConflict = errors.New("already exists")
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// timePtr turns a nullable timestamp column into an optional time
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// nameConflict turns a unique violation on segments.name into ErrConflict.
+// in_segment references segments by name, so names must stay unique.
+func nameConflict(err error, name string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "idx_segments_name" {
+		return fmt.Errorf("segment name %q %w", name, ErrConflict)
+	}
+	return err
+}
+
+// validID reports whether id can be compared against a UUID column.
+// Anything else would make Postgres reject the whole query.
+func validID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
+
+// SegmentRepository defines the operations for segment rules. Every change
+// records the segment's next version, attributed to author.
+type SegmentRepository interface {
+	Create(ctx context.Context, s *domain.Segment, author string) error
+	List(ctx context.Context) ([]domain.Segment, error)
+	ListActive(ctx context.Context) ([]domain.Segment, error)
+	Get(ctx context.Context, id string) (*domain.Segment, error)
+	GetByName(ctx context.Context, name string) (*domain.Segment, error)
+	Names(ctx context.Context, ids []string) (map[string]string, error)
+	Update(ctx context.Context, s *domain.Segment, author string) error
+	Delete(ctx context.Context, id, author string) error
+	SetActive(ctx context.Context, id string, active bool, author string) error
+}
+
+type postgresSegmentRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresSegmentRepository(db *sql.DB) SegmentRepository {
+	return &postgresSegmentRepo{db: db}
+}
+
+const segmentColumns = `id, name, rule_logic, is_active, starts_at, ends_at, version, created_at`
+
+// windowOpen is the SQL condition for a row of table alias t being inside
+// its starts_at/ends_at window, the counterpart of domain.InWindow
+func windowOpen(t string) string {
+	return `(` + t + `.starts_at IS NULL OR ` + t + `.starts_at <= NOW()) AND (` + t + `.ends_at IS NULL OR ` + t + `.ends_at > NOW())`
+}
+
+func scanSegment(row interface{ Scan(...any) error }) (*domain.Segment, error) {
+	s := &domain.Segment{}
+	var ruleLogic []byte
+	var startsAt, endsAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.Name, &ruleLogic, &s.IsActive, &startsAt, &endsAt, &s.Version, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+	s.RuleLogic = ruleLogic
+	s.StartsAt, s.EndsAt = timePtr(startsAt), timePtr(endsAt)
+	return s, nil
+}
+
+func (r *postgresSegmentRepo) Create(ctx context.Context, s *domain.Segment, author string) error {
+	query := `
+        INSERT INTO segments (name, rule_logic, is_active, starts_at, ends_at)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	v, err := versioned(ctx, r.db, author, "created", func(tx *sql.Tx) (string, error) {
+		err := tx.QueryRowContext(ctx, query, s.Name, []byte(s.RuleLogic), s.IsActive, s.StartsAt, s.EndsAt).Scan(&s.ID, &s.CreatedAt)
+		return s.ID, nameConflict(err, s.Name)
+	})
+	if err != nil {
+		return err
+	}
+	s.Version = v.Version
+	return nil
+}
+
+func (r *postgresSegmentRepo) List(ctx context.Context) ([]domain.Segment, error) {
+	return r.list(ctx, `SELECT `+segmentColumns+` FROM segments ORDER BY created_at`)
+}
+
+// ListActive returns the segments that should be evaluated now: active and
+// inside their scheduled window. Every evaluator loads segments through it.
+func (r *postgresSegmentRepo) ListActive(ctx context.Context) ([]domain.Segment, error) {
+	return r.list(ctx, `SELECT `+segmentColumns+` FROM segments s
+        WHERE s.is_active = true AND `+windowOpen("s")+`
+        ORDER BY s.created_at`)
+}
+
+func (r *postgresSegmentRepo) list(ctx context.Context, query string) ([]domain.Segment, error) {
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := []domain.Segment{}
+	for rows.Next() {
+		s, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, *s)
+	}
+	return segments, rows.Err()
+}
+
+func (r *postgresSegmentRepo) Get(ctx context.Context, id string) (*domain.Segment, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	s, err := scanSegment(r.db.QueryRowContext(ctx, `SELECT `+segmentColumns+` FROM segments WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return s, err
+}
+
+// GetByName looks a segment up by its unique name
+func (r *postgresSegmentRepo) GetByName(ctx context.Context, name string) (*domain.Segment, error) {
+	query := `SELECT ` + segmentColumns + ` FROM segments WHERE name = $1`
+	s, err := scanSegment(r.db.QueryRowContext(ctx, query, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return s, err
+}
+
+// Names maps segment IDs to their current names, for showing cached
+// memberships. IDs of segments that no longer exist are left out.
+func (r *postgresSegmentRepo) Names(ctx context.Context, ids []string) (map[string]string, error) {
+	names := make(map[string]string, len(ids))
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if validID(id) {
+			valid = append(valid, id)
+		}
+	}
+	if len(valid) == 0 {
+		return names, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT id, name FROM segments WHERE id = ANY($1)`, pq.Array(valid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+func (r *postgresSegmentRepo) Update(ctx context.Context, s *domain.Segment, author string) error {
+	if !validID(s.ID) {
+		return ErrNotFound
+	}
+	query := `
+        UPDATE segments SET name = $2, rule_logic = $3, is_active = $4, starts_at = $5, ends_at = $6
+        WHERE id = $1
+        RETURNING created_at`
+
+	v, err := versioned(ctx, r.db, author, "updated", func(tx *sql.Tx) (string, error) {
+		err := tx.QueryRowContext(ctx, query, s.ID, s.Name, []byte(s.RuleLogic), s.IsActive, s.StartsAt, s.EndsAt).Scan(&s.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return s.ID, nameConflict(err, s.Name)
+	})
+	if err != nil {
+		return err
+	}
+	s.Version = v.Version
+	return nil
+}
+
+func (r *postgresSegmentRepo) Delete(ctx context.Context, id, author string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	_, err := versioned(ctx, r.db, author, "deleted", func(tx *sql.Tx) (string, error) {
+		// Experiments reference the segment, so they have to go first
+		if _, err := tx.ExecContext(ctx, `DELETE FROM experiments WHERE segment_id = $1`, id); err != nil {
+			return "", err
+		}
+
+		res, err := tx.ExecContext(ctx, `DELETE FROM segments WHERE id = $1`, id)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return "", ErrNotFound
+		}
+		return id, nil
+	})
+	return err
+}
+
+func (r *postgresSegmentRepo) SetActive(ctx context.Context, id string, active bool, author string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	change := "deactivated"
+	if active {
+		change = "activated"
+	}
+	_, err := versioned(ctx, r.db, author, change, func(tx *sql.Tx) (string, error) {
+		res, err := tx.ExecContext(ctx, `UPDATE segments SET is_active = $2 WHERE id = $1`, id, active)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return "", ErrNotFound
+		}
+		return id, nil
+	})
+	return err
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// FeatureStrategyRepository stores the merge strategy for each feature key
+type FeatureStrategyRepository interface {
+	List(ctx context.Context) (map[string]domain.MergeStrategy, error)
+	Set(ctx context.Context, featureKey string, strategy domain.MergeStrategy) error
+	Delete(ctx context.Context, featureKey string) error
+}
+
+type postgresFeatureStrategyRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresFeatureStrategyRepository(db *sql.DB) FeatureStrategyRepository {
+	return &postgresFeatureStrategyRepo{db: db}
+}
+
+func (r *postgresFeatureStrategyRepo) List(ctx context.Context) (map[string]domain.MergeStrategy, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT feature_key, strategy FROM feature_strategies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	strategies := make(map[string]domain.MergeStrategy)
+	for rows.Next() {
+		var key, strategy string
+		if err := rows.Scan(&key, &strategy); err != nil {
+			return nil, err
+		}
+		strategies[key] = domain.MergeStrategy(strategy)
+	}
+	return strategies, rows.Err()
+}
+
+func (r *postgresFeatureStrategyRepo) Set(ctx context.Context, featureKey string, strategy domain.MergeStrategy) error {
+	query := `
+        INSERT INTO feature_strategies (feature_key, strategy)
+        VALUES ($1, $2)
+        ON CONFLICT (feature_key) DO UPDATE SET strategy = EXCLUDED.strategy`
+
+	_, err := r.db.ExecContext(ctx, query, featureKey, string(strategy))
+	return err
+}
+
+func (r *postgresFeatureStrategyRepo) Delete(ctx context.Context, featureKey string) error {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM feature_strategies WHERE feature_key = $1`, featureKey)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
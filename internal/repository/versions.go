@@ -0,0 +1,375 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// SegmentVersionRepository reads the history of every segment. Versions are
+// written by the segment and experiment repositories, in the transaction of
+// the change they record.
+type SegmentVersionRepository interface {
+	List(ctx context.Context, segmentID string) ([]domain.SegmentVersion, error)
+	Get(ctx context.Context, segmentID string, version int) (*domain.SegmentVersion, error)
+	Rollback(ctx context.Context, segmentID string, version int, author string) (*domain.SegmentVersion, error)
+}
+
+type postgresSegmentVersionRepo struct {
+	db *sql.DB
+}
+
+func NewPostgresSegmentVersionRepository(db *sql.DB) SegmentVersionRepository {
+	return &postgresSegmentVersionRepo{db: db}
+}
+
+const versionColumns = `segment_id, version, name, rule_logic, is_active, starts_at, ends_at, experiments, author, change, diff, created_at`
+
+func scanVersion(row interface{ Scan(...any) error }) (*domain.SegmentVersion, error) {
+	v := &domain.SegmentVersion{}
+	var ruleLogic, experiments, diff []byte
+	var startsAt, endsAt sql.NullTime
+	err := row.Scan(&v.SegmentID, &v.Version, &v.Name, &ruleLogic, &v.IsActive, &startsAt, &endsAt, &experiments, &v.Author, &v.Change, &diff, &v.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	v.RuleLogic = ruleLogic
+	v.StartsAt, v.EndsAt = timePtr(startsAt), timePtr(endsAt)
+	if err := json.Unmarshal(experiments, &v.Experiments); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(diff, &v.Diff); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// versioned runs mutate and records the segment it changed as its next
+// version in the same transaction, so a change never commits without its
+// version and a version never captures someone else's concurrent change.
+// mutate returns the ID of the segment it changed. Changes that leave the
+// snapshot identical are not recorded and the current version is returned.
+// Once the segment is deleted, the last snapshot is stored again to mark
+// the deletion.
+func versioned(ctx context.Context, db *sql.DB, author, change string, mutate func(tx *sql.Tx) (string, error)) (*domain.SegmentVersion, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	segmentID, err := mutate(tx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := record(ctx, tx, segmentID, author, change)
+	if err != nil {
+		return nil, fmt.Errorf("recording version of segment %s: %w", segmentID, err)
+	}
+	return v, tx.Commit()
+}
+
+func record(ctx context.Context, tx *sql.Tx, segmentID, author, change string) (*domain.SegmentVersion, error) {
+	// Lock the segment first so concurrent changes get consecutive versions
+	// and each diffs against the one before it
+	next := &domain.SegmentVersion{SegmentID: segmentID, Author: author, Change: change}
+	var ruleLogic []byte
+	var startsAt, endsAt sql.NullTime
+	var current int
+	lockErr := tx.QueryRowContext(ctx, `
+        SELECT name, rule_logic, is_active, starts_at, ends_at, version FROM segments WHERE id = $1 FOR UPDATE`, segmentID).
+		Scan(&next.Name, &ruleLogic, &next.IsActive, &startsAt, &endsAt, &current)
+	next.StartsAt, next.EndsAt = timePtr(startsAt), timePtr(endsAt)
+
+	prev, err := scanVersion(tx.QueryRowContext(ctx, `
+        SELECT `+versionColumns+` FROM segment_versions
+        WHERE segment_id = $1 ORDER BY version DESC LIMIT 1`, segmentID))
+	if errors.Is(err, sql.ErrNoRows) {
+		prev = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch err := lockErr; {
+	case errors.Is(err, sql.ErrNoRows):
+		if prev == nil {
+			return nil, ErrNotFound
+		}
+		next.Name, ruleLogic, next.IsActive = prev.Name, prev.RuleLogic, prev.IsActive
+		next.StartsAt, next.EndsAt = prev.StartsAt, prev.EndsAt
+		next.Experiments = []domain.Experiment{}
+	case err != nil:
+		return nil, err
+	default:
+		if next.Experiments, err = segmentExperiments(ctx, tx, segmentID); err != nil {
+			return nil, err
+		}
+	}
+	next.RuleLogic = ruleLogic
+
+	next.Diff, err = diffVersions(prev, next)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil && len(next.Diff) == 0 && change == "updated" {
+		return prev, nil
+	}
+
+	next.Version = current + 1
+	if prev != nil && prev.Version >= next.Version {
+		next.Version = prev.Version + 1
+	}
+
+	experiments, err := json.Marshal(next.Experiments)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := json.Marshal(next.Diff)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO segment_versions (segment_id, version, name, rule_logic, is_active, starts_at, ends_at, experiments, author, change, diff)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        RETURNING created_at`,
+		segmentID, next.Version, next.Name, []byte(next.RuleLogic), next.IsActive, next.StartsAt, next.EndsAt,
+		experiments, author, change, diff).Scan(&next.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE segments SET version = $2 WHERE id = $1`, segmentID, next.Version); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func segmentExperiments(ctx context.Context, tx *sql.Tx, segmentID string) ([]domain.Experiment, error) {
+	rows, err := tx.QueryContext(ctx, experimentSelect+`
+        WHERE e.segment_id = $1`+experimentOrder, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	experiments := []domain.Experiment{}
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			return nil, err
+		}
+		experiments = append(experiments, *e)
+	}
+	return experiments, rows.Err()
+}
+
+func (r *postgresSegmentVersionRepo) List(ctx context.Context, segmentID string) ([]domain.SegmentVersion, error) {
+	versions := []domain.SegmentVersion{}
+	if !validID(segmentID) {
+		return versions, nil
+	}
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT `+versionColumns+` FROM segment_versions
+        WHERE segment_id = $1 ORDER BY version DESC`, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, rows.Err()
+}
+
+func (r *postgresSegmentVersionRepo) Get(ctx context.Context, segmentID string, version int) (*domain.SegmentVersion, error) {
+	if !validID(segmentID) {
+		return nil, ErrNotFound
+	}
+	v, err := scanVersion(r.db.QueryRowContext(ctx, `
+        SELECT `+versionColumns+` FROM segment_versions
+        WHERE segment_id = $1 AND version = $2`, segmentID, version))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+// Rollback restores the segment and its experiments to an earlier version
+// and records the result as a new version, so history is never rewritten.
+// Experiments keep their IDs, so exposures and results still line up. A
+// deleted segment is recreated.
+func (r *postgresSegmentVersionRepo) Rollback(ctx context.Context, segmentID string, version int, author string) (*domain.SegmentVersion, error) {
+	target, err := r.Get(ctx, segmentID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO segments (id, name, rule_logic, is_active, starts_at, ends_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (id) DO UPDATE SET
+            name = EXCLUDED.name,
+            rule_logic = EXCLUDED.rule_logic,
+            is_active = EXCLUDED.is_active,
+            starts_at = EXCLUDED.starts_at,
+            ends_at = EXCLUDED.ends_at`,
+		segmentID, target.Name, []byte(target.RuleLogic), target.IsActive, target.StartsAt, target.EndsAt)
+	if err != nil {
+		return nil, nameConflict(err, target.Name)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM experiments WHERE segment_id = $1`, segmentID); err != nil {
+		return nil, err
+	}
+	for _, e := range target.Experiments {
+		variants, err := marshalVariants(e.Variants)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO experiments (id, segment_id, experiment_key, variant_data, variants, salt, priority, starts_at, ends_at, created_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			e.ID, segmentID, e.Key, []byte(e.Payload), variants, e.Salt, e.Priority, e.StartsAt, e.EndsAt, e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := record(ctx, tx, segmentID, author, fmt.Sprintf("rolled_back to v%d", version))
+	if err != nil {
+		return nil, err
+	}
+	return v, tx.Commit()
+}
+
+// diffVersions lists what changed from prev to next; everything is new
+// when there is no previous version
+func diffVersions(prev, next *domain.SegmentVersion) ([]domain.FieldChange, error) {
+	if prev == nil {
+		prev = &domain.SegmentVersion{}
+	}
+	changes := []domain.FieldChange{}
+	add := func(field string, from, to interface{}) error {
+		f, err := canonicalJSON(from)
+		if err != nil {
+			return err
+		}
+		t, err := canonicalJSON(to)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(f, t) {
+			changes = append(changes, domain.FieldChange{Field: field, From: f, To: t})
+		}
+		return nil
+	}
+
+	if err := add("name", nullIfEmpty(prev.Name), next.Name); err != nil {
+		return nil, err
+	}
+	if err := add("rule_logic", prev.RuleLogic, next.RuleLogic); err != nil {
+		return nil, err
+	}
+	var prevActive interface{}
+	if prev.Version > 0 {
+		prevActive = prev.IsActive
+	}
+	if err := add("is_active", prevActive, next.IsActive); err != nil {
+		return nil, err
+	}
+	if err := add("starts_at", prev.StartsAt, next.StartsAt); err != nil {
+		return nil, err
+	}
+	if err := add("ends_at", prev.EndsAt, next.EndsAt); err != nil {
+		return nil, err
+	}
+
+	// Experiments are matched by ID and labelled by key
+	before := make(map[string]domain.Experiment)
+	for _, e := range prev.Experiments {
+		before[e.ID] = e
+	}
+	seen := make(map[string]bool)
+	for _, e := range next.Experiments {
+		seen[e.ID] = true
+		label := "experiments." + e.Key
+		old, ok := before[e.ID]
+		if !ok {
+			if err := add(label, nil, e); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		oldFields := experimentFields(old)
+		for i, f := range experimentFields(e) {
+			if err := add(label+"."+f.name, oldFields[i].value, f.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, e := range prev.Experiments {
+		if !seen[e.ID] {
+			if err := add("experiments."+e.Key, e, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+type namedValue struct {
+	name  string
+	value interface{}
+}
+
+// experimentFields are the parts of an experiment a change can touch
+func experimentFields(e domain.Experiment) []namedValue {
+	return []namedValue{
+		{"key", e.Key},
+		{"payload", e.Payload},
+		{"variants", e.Variants},
+		{"salt", e.Salt},
+		{"priority", e.Priority},
+		{"starts_at", e.StartsAt},
+		{"ends_at", e.EndsAt},
+	}
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// canonicalJSON marshals v so equal values compare equal byte for byte,
+// whatever the key order or spacing of stored JSON
+func canonicalJSON(v interface{}) (json.RawMessage, error) {
+	if raw, ok := v.(json.RawMessage); ok {
+		if len(raw) == 0 {
+			return json.RawMessage("null"), nil
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return nil, err
+		}
+		v = decoded
+	}
+	return json.Marshal(v)
+}
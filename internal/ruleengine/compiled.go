@@ -0,0 +1,136 @@
+package ruleengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Rule is a segment rule parsed once and evaluated many times. Matching
+// walks the native expression tree against a context map straight from
+// BuildContext, so there is no JSON encoding or decoding per user.
+type Rule struct {
+	// Version identifies the rule text; two rules with the same version
+	// are the same rule.
+	Version string
+
+	root node
+}
+
+// RuleVersion is the content hash Compile uses as Rule.Version
+func RuleVersion(raw json.RawMessage) string {
+	return strconv.FormatUint(xxhash.Sum64(raw), 16)
+}
+
+// Compile parses a JSON-Logic rule into the native evaluator. It does not
+// type-check, so rules stored before TypeCheck existed keep evaluating.
+// Every operator the jsonlogic library accepts compiles and evaluates as
+// the library would, including reading null as 0 in ordering comparisons.
+func Compile(raw json.RawMessage) (*Rule, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("rule_logic is required")
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, fmt.Errorf("rule_logic is not valid JSON: %w", err)
+	}
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return nil, errors.New("rule_logic must be a JSON-Logic object")
+	}
+	root, err := parse(tree)
+	if err != nil {
+		return nil, fmt.Errorf("rule_logic is not supported: %w", err)
+	}
+	return &Rule{Version: RuleVersion(raw), root: root}, nil
+}
+
+// Match reports whether the rule evaluates to exactly true for data. The
+// tree is only read, so a Rule can be shared between goroutines. Any
+// in_segment reference is false; use MatchWith when the rule has
+// Dependencies.
+func (r *Rule) Match(data map[string]interface{}) (bool, error) {
+	return r.MatchWith(data, nil)
+}
+
+// MatchWith is Match for rules that reference other segments; segments
+// holds the names of the segments the user is already known to be in. It
+// fails when an operator evaluated by the jsonlogic library does, such as
+// reduce over something that is not a list.
+func (r *Rule) MatchWith(data map[string]interface{}, segments map[string]bool) (bool, error) {
+	s := &scope{data: data, segments: segments}
+	result := r.root.eval(s)
+	if s.err != nil {
+		return false, s.err
+	}
+	return result == true, nil
+}
+
+// Dependencies lists the segments the rule references with in_segment
+func (r *Rule) Dependencies() []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(n node)
+	walk = func(n node) {
+		switch t := n.(type) {
+		case segmentRef:
+			if !seen[t.name] {
+				seen[t.name] = true
+				names = append(names, t.name)
+			}
+		case opNode:
+			for _, a := range t.args {
+				walk(a)
+			}
+		case arrayNode:
+			for _, item := range t.items {
+				walk(item)
+			}
+		case varNode:
+			if t.def != nil {
+				walk(t.def)
+			}
+		}
+	}
+	walk(r.root)
+	return names
+}
+
+// Cache holds the compiled rule of each segment. A segment is recompiled
+// only when its rule text changes.
+type Cache struct {
+	mu    sync.RWMutex
+	rules map[string]*Rule
+}
+
+func NewCache() *Cache {
+	return &Cache{rules: make(map[string]*Rule)}
+}
+
+// Get returns the compiled rule for a segment, compiling raw if the cached
+// version is missing or stale.
+func (c *Cache) Get(segmentID string, raw json.RawMessage) (*Rule, error) {
+	version := RuleVersion(raw)
+
+	c.mu.RLock()
+	rule, ok := c.rules[segmentID]
+	c.mu.RUnlock()
+	if ok && rule.Version == version {
+		return rule, nil
+	}
+
+	rule, err := Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.rules[segmentID] = rule
+	c.mu.Unlock()
+	return rule, nil
+}
@@ -0,0 +1,130 @@
+package ruleengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+
+	"github.com/diegoholiveira/jsonlogic/v3"
+)
+
+// benchRules are shaped like the ones we run in production
+var benchRules = []json.RawMessage{
+	json.RawMessage(`{"and": [{">": [{"var": "orders_23d"}, 25]}]}`),
+	json.RawMessage(`{"and": [{">=": [{"var": "ltv"}, 5000]}, {"in": [{"var": "location_tag"}, ["blr", "del", "bom"]]}]}`),
+	json.RawMessage(`{"or": [{"<": [{"var": "days_since_last_order"}, 7]}, {"==": [{"var": "attr.tier"}, "gold"]}]}`),
+}
+
+func sampleUsers(n int) []map[string]interface{} {
+	now := time.Now()
+	locations := []string{"blr", "del", "bom", "hyd"}
+	users := make([]map[string]interface{}, n)
+	for i := range users {
+		m := domain.UserMetrics{
+			UserID:      fmt.Sprintf("U%d", i),
+			OrderCount:  i % 200,
+			Orders23d:   i % 40,
+			LastOrderAt: now.Add(-time.Duration(i%30) * 24 * time.Hour),
+			LocationTag: locations[i%len(locations)],
+			TotalSpend:  float64(i * 37 % 9000),
+			LTV:         float64(i * 37 % 9000),
+		}
+		var attrs []domain.UserAttribute
+		if i%3 == 0 {
+			attrs = []domain.UserAttribute{{Key: "tier", Type: domain.AttrString, Value: "gold"}}
+		}
+		users[i] = BuildContext(m, attrs, now)
+	}
+	return users
+}
+
+// applyJSONLogic is what cmd/cron and service.RunEvaluation used to do for
+// every user × segment pair: marshal the data, re-read the rule, apply,
+// compare the text
+func applyJSONLogic(tb testing.TB, rule json.RawMessage, data map[string]interface{}) bool {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var result bytes.Buffer
+	if err := jsonlogic.Apply(bytes.NewReader(rule), bytes.NewReader(dataBytes), &result); err != nil {
+		tb.Fatalf("jsonlogic.Apply(%s): %v", rule, err)
+	}
+	return strings.TrimSpace(result.String()) == "true"
+}
+
+func TestCompiledMatchesJSONLogic(t *testing.T) {
+	users := sampleUsers(1000)
+	for _, raw := range benchRules {
+		rule, err := Compile(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matched := 0
+		for _, data := range users {
+			want := applyJSONLogic(t, raw, data)
+			got, _ := rule.Match(data)
+			if got != want {
+				t.Fatalf("%s on %v: compiled=%v jsonlogic=%v", raw, data, got, want)
+			}
+			if got {
+				matched++
+			}
+		}
+		// Make sure the sample exercises both outcomes
+		if matched == 0 || matched == len(users) {
+			t.Errorf("%s matched %d of %d users", raw, matched, len(users))
+		}
+	}
+}
+
+func BenchmarkJSONLogicApply(b *testing.B) {
+	users := sampleUsers(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data := users[i%len(users)]
+		for _, rule := range benchRules {
+			applyJSONLogic(b, rule, data)
+		}
+	}
+}
+
+func BenchmarkCompiledMatch(b *testing.B) {
+	users := sampleUsers(1000)
+	compiled := make([]*Rule, len(benchRules))
+	for i, raw := range benchRules {
+		rule, err := Compile(raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compiled[i] = rule
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := users[i%len(users)]
+		for _, rule := range compiled {
+			rule.Match(data)
+		}
+	}
+}
+
+func TestCacheRecompilesChangedRules(t *testing.T) {
+	c := NewCache()
+	first, err := c.Get("s1", benchRules[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.Get("s1", benchRules[0]); again != first {
+		t.Error("unchanged rule was recompiled")
+	}
+	if changed, _ := c.Get("s1", benchRules[1]); changed == first || changed.Version == first.Version {
+		t.Error("changed rule was served from the cache")
+	}
+}
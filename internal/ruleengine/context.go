@@ -0,0 +1,79 @@
+package ruleengine
+
+import (
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// VarType is the JSON-Logic type of a rule variable
+type VarType string
+
+const (
+	TypeNumber VarType = "number"
+	TypeString VarType = "string"
+)
+
+// Variable documents one name a rule can read with {"var": ...}
+type Variable struct {
+	Name        string  `json:"name"`
+	Type        VarType `json:"type"`
+	Description string  `json:"description"`
+}
+
+// AttributeNamespace is where custom user attributes live in the context:
+// a "platform" attribute is read with {"var": "attr.platform"}.
+const AttributeNamespace = "attr"
+
+// Catalog is every built-in variable BuildContext provides. Besides these,
+// rules may read custom attributes under AttributeNamespace; anything else
+// resolves to null.
+var Catalog = []Variable{
+	{Name: "orders_23d", Type: TypeNumber, Description: "Orders placed in the last 23 days"},
+	{Name: "order_count_total", Type: TypeNumber, Description: "Orders placed over the user's lifetime"},
+	{Name: "total_spend", Type: TypeNumber, Description: "Lifetime spend"},
+	{Name: "ltv", Type: TypeNumber, Description: "Lifetime value (gross spend)"},
+	{Name: "location_tag", Type: TypeString, Description: "Location of the most recent order, 'unknown' if none"},
+	{Name: "last_order_at", Type: TypeNumber, Description: "Unix seconds of the most recent order; null if the user never ordered"},
+	{Name: "days_since_last_order", Type: TypeNumber, Description: "Whole days since the most recent order; null if the user never ordered"},
+}
+
+// BuildContext turns a user's metrics and custom attributes into the data
+// every rule is evaluated against. It is the only place that decides variable
+// names, so the cron, the bulk evaluation and the worker's hot path always
+// agree. Numbers are float64, which is what JSON-Logic compares; timestamp
+// attributes become unix seconds so they can be compared like last_order_at.
+func BuildContext(m domain.UserMetrics, attrs []domain.UserAttribute, now time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"orders_23d":            float64(m.Orders23d),
+		"order_count_total":     float64(m.OrderCount),
+		"total_spend":           m.TotalSpend,
+		"ltv":                   m.LTV,
+		"location_tag":          m.LocationTag,
+		"last_order_at":         nil,
+		"days_since_last_order": nil,
+	}
+	if !m.LastOrderAt.IsZero() {
+		data["last_order_at"] = float64(m.LastOrderAt.Unix())
+		data["days_since_last_order"] = float64(int(now.Sub(m.LastOrderAt).Hours() / 24))
+	}
+
+	custom := make(map[string]interface{}, len(attrs))
+	for _, a := range attrs {
+		custom[a.Key] = attributeValue(a)
+	}
+	data[AttributeNamespace] = custom
+	return data
+}
+
+func attributeValue(a domain.UserAttribute) interface{} {
+	if a.Type == domain.AttrTimestamp {
+		if s, ok := a.Value.(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return float64(t.Unix())
+			}
+		}
+		return nil
+	}
+	return a.Value
+}
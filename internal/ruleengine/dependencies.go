@@ -0,0 +1,134 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NamedRule is a segment's compiled rule, as needed to evaluate segments
+// that reference each other
+type NamedRule struct {
+	ID      string
+	Name    string
+	Version int // segment version the rule was loaded from
+	Rule    *Rule
+}
+
+// Order sorts rules so every segment comes after the segments it
+// references, keeping the input order otherwise. Rules caught in a cycle
+// cannot be ordered and are returned separately; the API refuses to save
+// them, so they only appear if the table was edited by hand.
+func Order(rules []NamedRule) (ordered, cyclic []NamedRule) {
+	byName := make(map[string][]int)
+	for i, r := range rules {
+		byName[r.Name] = append(byName[r.Name], i)
+	}
+
+	// pending[i] counts the dependencies of rule i not placed yet;
+	// references to unknown segments are not waited for
+	pending := make([]int, len(rules))
+	dependents := make([][]int, len(rules))
+	for i, r := range rules {
+		for _, dep := range r.Rule.Dependencies() {
+			for _, j := range byName[dep] {
+				pending[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	placed := make([]bool, len(rules))
+	for progress := true; progress; {
+		progress = false
+		for i := range rules {
+			if placed[i] || pending[i] > 0 {
+				continue
+			}
+			placed[i] = true
+			progress = true
+			ordered = append(ordered, rules[i])
+			for _, d := range dependents[i] {
+				pending[d]--
+			}
+		}
+	}
+
+	for i, r := range rules {
+		if !placed[i] {
+			cyclic = append(cyclic, r)
+		}
+	}
+	return ordered, cyclic
+}
+
+// MatchAll evaluates ordered rules (see Order) for one user. It returns the
+// rules that matched, and the names of the segments the user is in as
+// in_segment sees them.
+func MatchAll(ordered []NamedRule, data map[string]interface{}) ([]NamedRule, map[string]bool) {
+	var matched []NamedRule
+	segments := make(map[string]bool, len(ordered))
+	for _, r := range ordered {
+		if ok, _ := r.Rule.MatchWith(data, segments); ok {
+			matched = append(matched, r)
+			segments[r.Name] = true
+		}
+	}
+	return matched, segments
+}
+
+// CheckDependencies verifies that every segment a rule references exists
+// and that no chain of references leads back to itself. rules is every
+// segment, including the one being saved.
+func CheckDependencies(rules []NamedRule) error {
+	graph := make(map[string][]string)
+	for _, r := range rules {
+		graph[r.Name] = append(graph[r.Name], r.Rule.Dependencies()...)
+	}
+	for _, r := range rules {
+		for _, dep := range r.Rule.Dependencies() {
+			if _, ok := graph[dep]; !ok {
+				return fmt.Errorf("segment %q references unknown segment %q", r.Name, dep)
+			}
+		}
+	}
+
+	// Depth-first search; a grey node seen again closes a cycle
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		color[name] = grey
+		path = append(path, name)
+		for _, dep := range graph[name] {
+			switch color[dep] {
+			case grey:
+				start := 0
+				for path[start] != dep {
+					start++
+				}
+				cycle := append(append([]string{}, path[start:]...), dep)
+				return fmt.Errorf("segment references form a cycle: %s", strings.Join(cycle, " -> "))
+			case white:
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		color[name] = black
+		return nil
+	}
+	for _, r := range rules {
+		if color[r.Name] == white {
+			if err := visit(r.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
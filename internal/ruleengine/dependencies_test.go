@@ -0,0 +1,149 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// named compiles rules given as name => DSL, in order
+func named(t *testing.T, pairs ...string) []NamedRule {
+	t.Helper()
+	var rules []NamedRule
+	for i := 0; i < len(pairs); i += 2 {
+		raw, err := CompileDSL(pairs[i+1])
+		if err != nil {
+			t.Fatalf("%s: %v", pairs[i], err)
+		}
+		rule, err := Compile(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", pairs[i], err)
+		}
+		rules = append(rules, NamedRule{ID: "id-" + pairs[i], Name: pairs[i], Rule: rule})
+	}
+	return rules
+}
+
+func names(rules []NamedRule) []string {
+	var out []string
+	for _, r := range rules {
+		out = append(out, r.Name)
+	}
+	return out
+}
+
+func TestDependencies(t *testing.T) {
+	rule, err := Compile(json.RawMessage(`{"or": [{"in_segment": "a"}, {"and": [{"in_segment": "b"}, {"!": {"in_segment": "a"}}]}, {"var": ["x", {"in_segment": "c"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rule.Dependencies(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependencies = %v, want %v", got, want)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		ordered []string
+		cyclic  []string
+	}{
+		{
+			name:    "independent rules keep their order",
+			rules:   []string{"a", "ltv > 1", "b", "ltv > 2", "c", "ltv > 3"},
+			ordered: []string{"a", "b", "c"},
+		},
+		{
+			name:    "a chain is evaluated from the bottom",
+			rules:   []string{"top", `in_segment("mid")`, "mid", `in_segment("base") and ltv > 5`, "base", "ltv > 1"},
+			ordered: []string{"base", "mid", "top"},
+		},
+		{
+			name:    "diamond",
+			rules:   []string{"d", `in_segment("b") and in_segment("c")`, "b", `in_segment("a")`, "c", `in_segment("a")`, "a", "ltv > 1"},
+			ordered: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "unknown references are not waited for",
+			rules:   []string{"a", `in_segment("gone")`, "b", "ltv > 1"},
+			ordered: []string{"a", "b"},
+		},
+		{
+			name:    "cycles and what depends on them are left out",
+			rules:   []string{"x", `in_segment("y")`, "y", `in_segment("x")`, "z", `in_segment("x")`, "ok", "ltv > 1"},
+			ordered: []string{"ok"},
+			cyclic:  []string{"x", "y", "z"},
+		},
+		{
+			name:   "self reference",
+			rules:  []string{"self", `in_segment("self") or ltv > 1`},
+			cyclic: []string{"self"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered, cyclic := Order(named(t, tt.rules...))
+			if got := names(ordered); !reflect.DeepEqual(got, tt.ordered) {
+				t.Errorf("ordered = %v, want %v", got, tt.ordered)
+			}
+			if got := names(cyclic); !reflect.DeepEqual(got, tt.cyclic) {
+				t.Errorf("cyclic = %v, want %v", got, tt.cyclic)
+			}
+		})
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		err   string
+	}{
+		{"no references", []string{"a", "ltv > 1", "b", "ltv > 2"}, ""},
+		{"chain", []string{"a", `in_segment("b")`, "b", `in_segment("c")`, "c", "ltv > 1"}, ""},
+		{"unknown segment", []string{"a", `in_segment("nope")`}, `segment "a" references unknown segment "nope"`},
+		{"self reference", []string{"a", `in_segment("a")`}, "cycle: a -> a"},
+		{"two step cycle", []string{"a", `in_segment("b")`, "b", `in_segment("a")`}, "cycle: a -> b -> a"},
+		{"cycle below a valid segment", []string{"top", `in_segment("x")`, "x", `in_segment("y")`, "y", `ltv > 1 and in_segment("x")`}, "cycle: x -> y -> x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDependencies(named(t, tt.rules...))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMatchAll(t *testing.T) {
+	ordered, _ := Order(named(t,
+		"vip", `in_segment("spender") and orders_23d > 5`,
+		"lapsed", `not in_segment("spender")`,
+		"spender", "ltv > 1000",
+	))
+	tests := []struct {
+		ltv, orders float64
+		want        []string
+	}{
+		{5000, 10, []string{"spender", "vip"}},
+		{5000, 1, []string{"spender"}},
+		{10, 10, []string{"lapsed"}},
+	}
+	for _, tt := range tests {
+		matched, segments := MatchAll(ordered, map[string]interface{}{"ltv": tt.ltv, "orders_23d": tt.orders})
+		if got := names(matched); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ltv %v, orders %v: matched %v, want %v", tt.ltv, tt.orders, got, tt.want)
+		}
+		for _, name := range tt.want {
+			if !segments[name] {
+				t.Errorf("ltv %v, orders %v: %s missing from %v", tt.ltv, tt.orders, name, segments)
+			}
+		}
+	}
+}
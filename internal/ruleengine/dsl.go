@@ -0,0 +1,627 @@
+package ruleengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The rule DSL is a readable way to write segment rules, e.g.
+//
+//	orders_23d > 25 and location_tag in ["blr", "del"]
+//
+// It compiles to the JSON-Logic stored in segments.rule_logic, and
+// Decompile turns stored rules back into it. From loosest to tightest:
+//
+//	or
+//	and
+//	not
+//	== != === !== < <= > >= in, not in
+//	+ -
+//	* / %
+//	unary -
+//
+// Variables are bare names (attr.platform for custom attributes); literals
+// are numbers, "strings", true, false, null and [lists]. min, max, cat and
+// if are written as function calls: if(cond, then, else). Another segment is
+// referenced with in_segment("Power User").
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // 1-based column, for error messages
+}
+
+// dslOperators is longest first so ">=" is not read as ">"
+var dslOperators = []string{"===", "!==", "==", "!=", ">=", "<=", ">", "<", "+", "-", "*", "/", "%", "(", ")", "[", "]", ","}
+
+// dslFunctions are the JSON-Logic operators written as calls
+var dslFunctions = map[string]bool{"min": true, "max": true, "cat": true, "if": true, "in_segment": true}
+
+var dslKeywords = map[string]bool{"and": true, "or": true, "not": true, "in": true, "true": true, "false": true, "null": true}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && rune(src[end]) != c {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at column %d", i+1)
+			}
+			text, err := unquote(src[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at column %d: %w", i+1, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: i + 1})
+			i = end + 1
+
+		case isDigit(src[i]) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			end := i
+			for end < len(src) && (isDigit(src[end]) || src[end] == '.' || src[end] == 'e' || src[end] == 'E' ||
+				(src[end] == '-' || src[end] == '+') && (src[end-1] == 'e' || src[end-1] == 'E')) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:end], pos: i + 1})
+			i = end
+
+		case isIdentByte(src[i]) && !isDigit(src[i]):
+			end := i
+			for end < len(src) && (isIdentByte(src[end]) || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:end], pos: i + 1})
+			i = end
+
+		default:
+			matched := false
+			for _, op := range dslOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i + 1})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at column %d", c, i+1)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src) + 1}), nil
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || isDigit(b) || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// unquote accepts "double" or 'single' quoted strings with Go escapes
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// dslParser is a recursive descent parser producing JSON-Logic values
+type dslParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *dslParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *dslParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given operator or keyword
+func (p *dslParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokOp || t.kind == tokIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *dslParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *dslParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	found := "end of rule"
+	if t.kind != tokEOF {
+		found = strconv.Quote(t.text)
+	}
+	return fmt.Errorf("%s at column %d, found %s", fmt.Sprintf(format, args...), t.pos, found)
+}
+
+// CompileDSL turns a DSL rule into the JSON-Logic stored on the segment
+func CompileDSL(src string) (json.RawMessage, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("rule: %w", err)
+	}
+	p := &dslParser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, fmt.Errorf("rule is empty")
+	}
+
+	tree, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("rule: %w", err)
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("rule: %w", p.errorf("unexpected input"))
+	}
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("rule must be a condition, not a single value")
+	}
+	// Keep < and > readable in the stored rule instead of \u003c
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(tree); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(bytes.TrimSpace(buf.Bytes())), nil
+}
+
+func op(name string, args ...interface{}) map[string]interface{} {
+	return map[string]interface{}{name: args}
+}
+
+// parseChain parses left-associative operators; and, or, + and * are
+// n-ary in JSON-Logic, so a chain of them becomes one operation.
+func (p *dslParser) parseChain(ops []string, operand func() (interface{}, error)) (interface{}, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var matched string
+		for _, o := range ops {
+			if p.accept(o) {
+				matched = o
+				break
+			}
+		}
+		if matched == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+
+		// Associative operators collect into one list
+		if matched == "and" || matched == "or" || matched == "+" || matched == "*" {
+			if m, ok := left.(map[string]interface{}); ok && len(m) == 1 {
+				if args, ok := m[matched].([]interface{}); ok {
+					m[matched] = append(args, right)
+					continue
+				}
+			}
+		}
+		left = op(matched, left, right)
+	}
+}
+
+func (p *dslParser) parseOr() (interface{}, error) {
+	return p.parseChain([]string{"or"}, p.parseAnd)
+}
+
+func (p *dslParser) parseAnd() (interface{}, error) {
+	return p.parseChain([]string{"and"}, p.parseNot)
+}
+
+func (p *dslParser) parseNot() (interface{}, error) {
+	if p.accept("not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"!": operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = []string{"===", "!==", "==", "!=", ">=", "<=", ">", "<", "in"}
+
+// parseComparison reads at most one comparison; comparisons do not chain,
+// except a < b < c (or <=), which is JSON-Logic's "between".
+func (p *dslParser) parseComparison() (interface{}, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	negate := false
+	if t := p.peek(); t.kind == tokIdent && t.text == "not" && p.tokens[p.pos+1].text == "in" {
+		p.pos += 2
+		negate = true
+	}
+
+	var matched string
+	if negate {
+		matched = "in"
+	} else {
+		for _, o := range comparisonOps {
+			if p.accept(o) {
+				matched = o
+				break
+			}
+		}
+	}
+	if matched == "" {
+		return left, nil
+	}
+
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return map[string]interface{}{"!": op("in", left, right)}, nil
+	}
+	if (matched == "<" || matched == "<=") && p.accept(matched) {
+		upper, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return op(matched, left, right, upper), nil
+	}
+	return op(matched, left, right), nil
+}
+
+func (p *dslParser) parseAdditive() (interface{}, error) {
+	return p.parseChain([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *dslParser) parseMultiplicative() (interface{}, error) {
+	return p.parseChain([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *dslParser) parseUnary() (interface{}, error) {
+	if p.accept("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := operand.(float64); ok {
+			return -n, nil
+		}
+		return op("-", operand), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *dslParser) parsePrimary() (interface{}, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at column %d", t.text, t.pos)
+		}
+		return n, nil
+
+	case tokString:
+		p.next()
+		return t.text, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			p.next()
+			return true, nil
+		case "false":
+			p.next()
+			return false, nil
+		case "null":
+			p.next()
+			return nil, nil
+		}
+		if dslKeywords[t.text] {
+			return nil, p.errorf("expected a value")
+		}
+		p.next()
+		if dslFunctions[t.text] && p.accept("(") {
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			if t.text == "in_segment" {
+				if len(args) != 1 || !isString(args[0]) {
+					return nil, fmt.Errorf("in_segment takes one quoted segment name at column %d", t.pos)
+				}
+				return map[string]interface{}{"in_segment": args[0]}, nil
+			}
+			return op(t.text, args...), nil
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return nil, fmt.Errorf("unknown function %q at column %d", t.text, t.pos)
+		}
+		if !identPattern.MatchString(t.text) {
+			return nil, fmt.Errorf("bad variable name %q at column %d", t.text, t.pos)
+		}
+		return map[string]interface{}{"var": t.text}, nil
+
+	case tokOp:
+		switch t.text {
+		case "(":
+			p.next()
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			p.next()
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return items, nil
+		}
+	}
+	return nil, p.errorf("expected a value")
+}
+
+// parseList reads comma separated expressions up to the closing token
+func (p *dslParser) parseList(closing string) ([]interface{}, error) {
+	items := []interface{}{}
+	if p.accept(closing) {
+		return items, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept(closing) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// identPattern is a variable name, optionally dotted like attr.platform
+var identPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Precedence levels used when decompiling, loosest first
+const (
+	precOr = iota + 1
+	precAnd
+	precNot
+	precCompare
+	precAdd
+	precMul
+	precUnary
+	precPrimary
+)
+
+// Decompile renders a stored JSON-Logic rule in the DSL. Rules using
+// features the DSL has no syntax for, such as var defaults, return an error.
+func Decompile(raw json.RawMessage) (string, error) {
+	rule, err := Compile(raw)
+	if err != nil {
+		return "", err
+	}
+	s, _, err := format(rule.root)
+	return s, err
+}
+
+// format returns the DSL for n and its precedence, so callers know when
+// to add parentheses
+func format(n node) (string, int, error) {
+	switch t := n.(type) {
+	case literal:
+		return formatLiteral(t.value)
+
+	case arrayNode:
+		items, err := formatArgs(t.items)
+		if err != nil {
+			return "", 0, err
+		}
+		return "[" + strings.Join(items, ", ") + "]", precPrimary, nil
+
+	case varNode:
+		if t.def != nil {
+			return "", 0, fmt.Errorf("var %q has a default, which the DSL cannot express", t.name)
+		}
+		if !identPattern.MatchString(t.name) || dslKeywords[t.name] {
+			return "", 0, fmt.Errorf("var %q is not a valid DSL name", t.name)
+		}
+		return t.name, precPrimary, nil
+
+	case opNode:
+		return formatOp(t)
+
+	case segmentRef:
+		return "in_segment(" + strconv.Quote(t.name) + ")", precPrimary, nil
+
+	case libraryNode:
+		return "", 0, fmt.Errorf("%q cannot be expressed in the DSL", t.op)
+	}
+	return "", 0, fmt.Errorf("unsupported expression %T", n)
+}
+
+func formatLiteral(v interface{}) (string, int, error) {
+	switch t := v.(type) {
+	case nil:
+		return "null", precPrimary, nil
+	case bool:
+		return strconv.FormatBool(t), precPrimary, nil
+	case string:
+		return strconv.Quote(t), precPrimary, nil
+	case float64:
+		if t < 0 {
+			return strconv.FormatFloat(t, 'f', -1, 64), precUnary, nil
+		}
+		return strconv.FormatFloat(t, 'f', -1, 64), precPrimary, nil
+	}
+	return "", 0, fmt.Errorf("literal %v cannot be expressed in the DSL", v)
+}
+
+func formatArgs(args []node) ([]string, error) {
+	out := make([]string, len(args))
+	for i, a := range args {
+		s, _, err := format(a)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// operand formats a child, wrapping it in parentheses when it binds more
+// loosely than min
+func operand(n node, min int) (string, error) {
+	s, prec, err := format(n)
+	if err != nil {
+		return "", err
+	}
+	if prec < min {
+		return "(" + s + ")", nil
+	}
+	return s, nil
+}
+
+func formatOp(n opNode) (string, int, error) {
+	// join renders args with the separator, each binding at least as
+	// tightly as min
+	join := func(sep string, prec int, mins ...int) (string, int, error) {
+		parts := make([]string, len(n.args))
+		for i, a := range n.args {
+			min := mins[len(mins)-1]
+			if i < len(mins) {
+				min = mins[i]
+			}
+			s, err := operand(a, min)
+			if err != nil {
+				return "", 0, err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, sep), prec, nil
+	}
+
+	switch n.op {
+	case "or":
+		if len(n.args) >= 2 {
+			return join(" or ", precOr, precOr+1)
+		}
+	case "and":
+		if len(n.args) >= 2 {
+			return join(" and ", precAnd, precAnd+1)
+		}
+
+	case "!":
+		if len(n.args) == 1 {
+			if in, ok := n.args[0].(opNode); ok && in.op == "in" && len(in.args) == 2 {
+				s, _, err := formatOp(opNode{op: "not in", args: in.args})
+				return s, precCompare, err
+			}
+			s, err := operand(n.args[0], precNot)
+			return "not " + s, precNot, err
+		}
+	case "!!":
+		if len(n.args) == 1 {
+			s, err := operand(n.args[0], precNot)
+			return "not not " + s, precNot, err
+		}
+
+	case "==", "!=", "===", "!==", ">", ">=", "in", "not in":
+		if len(n.args) == 2 {
+			return join(" "+n.op+" ", precCompare, precAdd)
+		}
+	case "<", "<=":
+		if len(n.args) == 2 || len(n.args) == 3 {
+			return join(" "+n.op+" ", precCompare, precAdd)
+		}
+
+	case "+", "*":
+		prec := precAdd
+		if n.op == "*" {
+			prec = precMul
+		}
+		if len(n.args) >= 2 {
+			return join(" "+n.op+" ", prec, prec+1)
+		}
+	case "-":
+		if len(n.args) == 1 {
+			s, err := operand(n.args[0], precUnary)
+			return "-" + s, precUnary, err
+		}
+		if len(n.args) == 2 {
+			return join(" - ", precAdd, precAdd, precAdd+1)
+		}
+	case "/", "%":
+		if len(n.args) == 2 {
+			return join(" "+n.op+" ", precMul, precMul, precMul+1)
+		}
+
+	case "min", "max", "cat", "if", "?:":
+		name := n.op
+		if name == "?:" {
+			name = "if"
+		}
+		args, err := formatArgs(n.args)
+		if err != nil {
+			return "", 0, err
+		}
+		return name + "(" + strings.Join(args, ", ") + ")", precPrimary, nil
+	}
+	return "", 0, fmt.Errorf("%q with %d arguments cannot be expressed in the DSL", n.op, len(n.args))
+}
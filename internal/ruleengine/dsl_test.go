@@ -0,0 +1,187 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDSLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		json string
+		dsl  string // what Decompile gives back; src when empty
+	}{
+		{
+			name: "comparison",
+			src:  `orders_23d > 25`,
+			json: `{">":[{"var":"orders_23d"},25]}`,
+		},
+		{
+			name: "and binds tighter than or",
+			src:  `ltv > 10 or orders_23d > 1 and location_tag == "blr"`,
+			json: `{"or":[{">":[{"var":"ltv"},10]},{"and":[{">":[{"var":"orders_23d"},1]},{"==":[{"var":"location_tag"},"blr"]}]}]}`,
+		},
+		{
+			name: "parentheses override precedence",
+			src:  `(ltv > 10 or orders_23d > 1) and location_tag == "blr"`,
+			json: `{"and":[{"or":[{">":[{"var":"ltv"},10]},{">":[{"var":"orders_23d"},1]}]},{"==":[{"var":"location_tag"},"blr"]}]}`,
+		},
+		{
+			name: "chains collect into one operation",
+			src:  `ltv > 1 and ltv > 2 and ltv > 3`,
+			json: `{"and":[{">":[{"var":"ltv"},1]},{">":[{"var":"ltv"},2]},{">":[{"var":"ltv"},3]}]}`,
+		},
+		{
+			name: "multiplication binds tighter than addition",
+			src:  `ltv + total_spend * 2 >= 100`,
+			json: `{">=":[{"+":[{"var":"ltv"},{"*":[{"var":"total_spend"},2]}]},100]}`,
+		},
+		{
+			name: "subtraction is left associative",
+			src:  `ltv - 1 - 2 > 0`,
+			json: `{">":[{"-":[{"-":[{"var":"ltv"},1]},2]},0]}`,
+		},
+		{
+			name: "parentheses on the right of a subtraction are kept",
+			src:  `ltv - (1 - 2) > 0`,
+			json: `{">":[{"-":[{"var":"ltv"},{"-":[1,2]}]},0]}`,
+		},
+		{
+			name: "not binds looser than comparison",
+			src:  `not orders_23d > 5`,
+			json: `{"!":{">":[{"var":"orders_23d"},5]}}`,
+		},
+		{
+			name: "not around and keeps its parentheses",
+			src:  `not (ltv > 1 and ltv < 5)`,
+			json: `{"!":{"and":[{">":[{"var":"ltv"},1]},{"<":[{"var":"ltv"},5]}]}}`,
+		},
+		{
+			name: "in a list",
+			src:  `location_tag in ["blr", "del"]`,
+			json: `{"in":[{"var":"location_tag"},["blr","del"]]}`,
+		},
+		{
+			name: "not in",
+			src:  `location_tag not in ["blr", "del"]`,
+			json: `{"!":{"in":[{"var":"location_tag"},["blr","del"]]}}`,
+		},
+		{
+			name: "between",
+			src:  `10 <= orders_23d <= 30`,
+			json: `{"<=":[10,{"var":"orders_23d"},30]}`,
+		},
+		{
+			name: "strict between",
+			src:  `0 < days_since_last_order < 7`,
+			json: `{"<":[0,{"var":"days_since_last_order"},7]}`,
+		},
+		{
+			name: "negative literal",
+			src:  `ltv > -5`,
+			json: `{">":[{"var":"ltv"},-5]}`,
+		},
+		{
+			name: "unary minus on a variable",
+			src:  `-ltv < 0`,
+			json: `{"<":[{"-":[{"var":"ltv"}]},0]}`,
+		},
+		{
+			name: "unary minus on a group",
+			src:  `-(ltv - total_spend) > 5`,
+			json: `{">":[{"-":[{"-":[{"var":"ltv"},{"var":"total_spend"}]}]},5]}`,
+		},
+		{
+			name: "in_segment",
+			src:  `in_segment("Power User") and not in_segment("churned")`,
+			json: `{"and":[{"in_segment":"Power User"},{"!":{"in_segment":"churned"}}]}`,
+		},
+		{
+			name: "function calls",
+			src:  `max(ltv, total_spend) > 10 and cat("x", location_tag) == "xblr"`,
+			json: `{"and":[{">":[{"max":[{"var":"ltv"},{"var":"total_spend"}]},10]},{"==":[{"cat":["x",{"var":"location_tag"}]},"xblr"]}]}`,
+		},
+		{
+			name: "custom attributes and literals",
+			src:  `attr.beta == true and attr.plan != null`,
+			json: `{"and":[{"==":[{"var":"attr.beta"},true]},{"!=":[{"var":"attr.plan"},null]}]}`,
+		},
+		{
+			name: "redundant parentheses are dropped",
+			src:  `((orders_23d)) > (5)`,
+			json: `{">":[{"var":"orders_23d"},5]}`,
+			dsl:  `orders_23d > 5`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := CompileDSL(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != tt.json {
+				t.Errorf("CompileDSL = %s, want %s", raw, tt.json)
+			}
+
+			want := tt.dsl
+			if want == "" {
+				want = tt.src
+			}
+			got, err := Decompile(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("Decompile = %s, want %s", got, want)
+			}
+
+			// The decompiled rule must compile back to the same JSON
+			again, err := CompileDSL(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(raw) {
+				t.Errorf("round trip = %s, want %s", again, raw)
+			}
+		})
+	}
+}
+
+func TestCompileDSLErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{``, "rule is empty"},
+		{`"blr"`, "rule must be a condition"},
+		{`orders_23d > `, "expected a value at column 14, found end of rule"},
+		{`orders_23d > 5 5`, `unexpected input at column 16, found "5"`},
+		{`(ltv > 5`, `expected ")" at column 9, found end of rule`},
+		{`ltv > 5 and and`, `expected a value at column 13, found "and"`},
+		{`location_tag == "blr`, "unterminated string at column 17"},
+		{`ltv # 5`, `unexpected '#' at column 5`},
+		{`foo(1) > 0`, `unknown function "foo" at column 1`},
+		{`ltv > 1 and in_segment(5)`, "in_segment takes one quoted segment name at column 13"},
+		{`ltv in [1, 2`, `expected "," at column 13, found end of rule`},
+	}
+	for _, tt := range tests {
+		_, err := CompileDSL(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: err = %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestDecompileUnsupported(t *testing.T) {
+	for _, raw := range []string{
+		`{"var": ["ltv", 0]}`,
+		`{"some": [[1], {"var": ""}]}`,
+		`{"substr": ["abc", 1]}`,
+	} {
+		if s, err := Decompile(json.RawMessage(raw)); err == nil {
+			t.Errorf("%s decompiled to %q", raw, s)
+		}
+	}
+}
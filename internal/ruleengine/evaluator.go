@@ -1,24 +1,35 @@
 package ruleengine
 
 import (
-	"bytes"
 	"encoding/json"
-	"github.com/diegoholiveira/jsonlogic/v3"
+	"fmt"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
 )
 
 // Evaluate checks if a user's metrics match a segment's JSON rule.
-func Evaluate(rule json.RawMessage, data interface{}) (bool, error) {
-	dataBytes, err := json.Marshal(data)
+// Loops over many users should Compile the rule once and call Match instead.
+func Evaluate(rule json.RawMessage, data map[string]interface{}) (bool, error) {
+	compiled, err := Compile(rule)
 	if err != nil {
 		return false, err
 	}
+	return compiled.Match(data)
+}
 
-	var result bytes.Buffer
-	err = jsonlogic.Apply(bytes.NewReader(rule), bytes.NewReader(dataBytes), &result)
+// Validate checks that a rule is well-formed JSON-Logic before it is stored.
+// It type-checks the rule against the variable catalog, then applies it once
+// against a blank user, so rules that only blow up at evaluation time are
+// caught here rather than in the cron run.
+func Validate(rule json.RawMessage) error {
+	compiled, err := Compile(rule)
 	if err != nil {
-		return false, err
+		return err
 	}
-
-	// The library returns "true" or "false" as a string in the buffer
-	return result.String() == "true", nil
-}
\ No newline at end of file
+	if err := TypeCheck(compiled); err != nil {
+		return fmt.Errorf("rule_logic is invalid: %w", err)
+	}
+	_, err = compiled.Match(BuildContext(domain.UserMetrics{}, nil, time.Now()))
+	return err
+}
@@ -0,0 +1,596 @@
+package ruleengine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/diegoholiveira/jsonlogic/v3"
+)
+
+// The native evaluator walks a tree built once from the rule's JSON. It
+// implements the JSON-Logic operators our segments use with the library's
+// semantics; the list-iterating operators (some, all, none, map, filter,
+// reduce) and any other operator the library knows are handed to the
+// library as a subtree, so every rule it accepted still evaluates.
+//
+// Ordering comparisons (<, <=, >, >=) read null as 0 like the library, so
+// stored rules keep matching the same users: null < 7 is true, and
+// {"<": [{"var": "days_since_last_order"}, 7]} matches users who never
+// ordered. Rules that mean "ordered recently" test for null explicitly, e.g.
+// {"and": [{"!=": [{"var": "days_since_last_order"}, null]}, ...]}.
+
+// node is one expression of a compiled rule
+type node interface {
+	eval(s *scope) interface{}
+}
+
+// scope is what a rule is evaluated against: the user's context and the
+// segments they are already known to be in, by name. err is the first error
+// raised while evaluating; only library subtrees can raise one.
+type scope struct {
+	data     map[string]interface{}
+	segments map[string]bool
+	err      error
+}
+
+func (s *scope) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+type literal struct {
+	value interface{}
+}
+
+type arrayNode struct {
+	items []node
+}
+
+type varNode struct {
+	name string
+	def  node // value when the variable is missing, may be nil
+}
+
+type opNode struct {
+	op   string
+	args []node
+}
+
+// libraryNode is an operator the native evaluator does not implement. Its
+// raw subtree is applied with the jsonlogic library, which is slower but
+// keeps the library's semantics exactly.
+type libraryNode struct {
+	op  string
+	raw interface{}
+}
+
+// segmentRef is {"in_segment": "name"}: whether the user is in another
+// segment. The name must be a literal so dependencies are known up front.
+type segmentRef struct {
+	name string
+}
+
+// operators lists every operator the native evaluator supports
+var operators = map[string]bool{
+	"var": true,
+	"==":  true, "!=": true, "===": true, "!==": true,
+	">": true, ">=": true, "<": true, "<=": true,
+	"!": true, "!!": true, "and": true, "or": true, "if": true, "?:": true,
+	"in": true, "cat": true, "substr": true, "in_segment": true,
+	"missing": true, "missing_some": true, "merge": true,
+	"+": true, "-": true, "*": true, "/": true, "%": true, "min": true, "max": true, "abs": true,
+}
+
+// libraryOperator reports whether the jsonlogic library knows op, including
+// operators registered with jsonlogic.AddOperator
+func libraryOperator(op string) bool {
+	return jsonlogic.ValidateJsonLogic(map[string]interface{}{op: []interface{}{}})
+}
+
+// parse builds the expression tree from a decoded JSON value
+func parse(v interface{}) (node, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		// A map with more than one key is data, not an operation
+		if len(t) != 1 {
+			return literal{value: t}, nil
+		}
+		for op, raw := range t {
+			return parseOp(op, raw)
+		}
+	case []interface{}:
+		items := make([]node, len(t))
+		for i, item := range t {
+			n, err := parse(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = n
+		}
+		return arrayNode{items: items}, nil
+	}
+	return literal{value: v}, nil
+}
+
+func parseOp(op string, raw interface{}) (node, error) {
+	if !operators[op] {
+		if !libraryOperator(op) {
+			return nil, fmt.Errorf("unknown operator %q", op)
+		}
+		// The library cannot see the segments the user is in
+		if referencesSegment(raw) {
+			return nil, fmt.Errorf("in_segment cannot be used inside %q", op)
+		}
+		return libraryNode{op: op, raw: raw}, nil
+	}
+
+	if op == "var" {
+		return parseVar(raw)
+	}
+	if op == "in_segment" {
+		return parseSegmentRef(raw)
+	}
+
+	// Operators take an argument list; a single value is shorthand for [value]
+	list, ok := raw.([]interface{})
+	if !ok {
+		list = []interface{}{raw}
+	}
+	args := make([]node, len(list))
+	for i, item := range list {
+		n, err := parse(item)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = n
+	}
+	return opNode{op: op, args: args}, nil
+}
+
+func parseVar(raw interface{}) (node, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		list = []interface{}{raw}
+	}
+	if len(list) == 0 {
+		return varNode{}, nil
+	}
+
+	v := varNode{}
+	switch name := list[0].(type) {
+	case string:
+		v.name = name
+	case float64:
+		v.name = strconv.FormatFloat(name, 'f', -1, 64)
+	case nil:
+	default:
+		return nil, fmt.Errorf("var name must be a string, got %v", list[0])
+	}
+
+	if len(list) > 1 {
+		def, err := parse(list[1])
+		if err != nil {
+			return nil, err
+		}
+		v.def = def
+	}
+	return v, nil
+}
+
+func parseSegmentRef(raw interface{}) (node, error) {
+	if list, ok := raw.([]interface{}); ok && len(list) == 1 {
+		raw = list[0]
+	}
+	name, ok := raw.(string)
+	if !ok || strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("in_segment takes one segment name, got %v", raw)
+	}
+	return segmentRef{name: name}, nil
+}
+
+// referencesSegment reports whether a raw subtree contains in_segment
+func referencesSegment(v interface{}) bool {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			if k == "in_segment" || referencesSegment(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range t {
+			if referencesSegment(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n literal) eval(*scope) interface{} {
+	return n.value
+}
+
+func (n arrayNode) eval(s *scope) interface{} {
+	out := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		out[i] = item.eval(s)
+	}
+	return out
+}
+
+func (n varNode) eval(s *scope) interface{} {
+	if n.name == "" {
+		return s.data
+	}
+	if v, ok := lookup(s.data, n.name); ok && v != nil {
+		return v
+	}
+	if n.def != nil {
+		return n.def.eval(s)
+	}
+	return nil
+}
+
+func (n libraryNode) eval(s *scope) interface{} {
+	out, err := jsonlogic.ApplyInterface(map[string]interface{}{n.op: n.raw}, s.data)
+	if err != nil {
+		s.fail(fmt.Errorf("%s: %w", n.op, err))
+		return nil
+	}
+	return out
+}
+
+func (n segmentRef) eval(s *scope) interface{} {
+	return s.segments[n.name]
+}
+
+// lookup resolves a dotted path such as "attr.platform"
+func lookup(data map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func (n opNode) eval(s *scope) interface{} {
+	switch n.op {
+	case "and":
+		var last interface{} = false
+		for _, a := range n.args {
+			last = a.eval(s)
+			if !truthy(last) {
+				return last
+			}
+		}
+		return last
+
+	case "or":
+		var last interface{} = false
+		for _, a := range n.args {
+			last = a.eval(s)
+			if truthy(last) {
+				return last
+			}
+		}
+		return last
+
+	case "if", "?:":
+		// [cond1, then1, cond2, then2, ..., else]
+		i := 0
+		for ; i+1 < len(n.args); i += 2 {
+			if truthy(n.args[i].eval(s)) {
+				return n.args[i+1].eval(s)
+			}
+		}
+		if i < len(n.args) {
+			return n.args[i].eval(s)
+		}
+		return nil
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		args[i] = a.eval(s)
+	}
+	return apply(s, n.op, args)
+}
+
+// apply runs an operator whose arguments are already evaluated
+func apply(s *scope, op string, args []interface{}) interface{} {
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+
+	switch op {
+	case "!":
+		return !truthy(arg(0))
+	case "!!":
+		return truthy(arg(0))
+
+	case "==":
+		return looseEquals(arg(0), arg(1))
+	case "!=":
+		return !looseEquals(arg(0), arg(1))
+	case "===":
+		return strictEquals(arg(0), arg(1))
+	case "!==":
+		return !strictEquals(arg(0), arg(1))
+
+	case "<", "<=", ">", ">=":
+		// Three arguments is the "between" form: a < b < c
+		if len(args) == 3 {
+			return compare(op, args[0], args[1]) && compare(op, args[1], args[2])
+		}
+		return compare(op, arg(0), arg(1))
+
+	case "in":
+		switch haystack := arg(1).(type) {
+		case []interface{}:
+			for _, item := range haystack {
+				if looseEquals(arg(0), item) {
+					return true
+				}
+			}
+			return false
+		case string:
+			return strings.Contains(haystack, toString(arg(0)))
+		}
+		return false
+
+	case "cat":
+		if len(args) == 1 {
+			return toString(args[0])
+		}
+		// Like the library, joining several values trims the result
+		var b strings.Builder
+		for _, a := range args {
+			b.WriteString(toString(a))
+		}
+		return strings.TrimSpace(b.String())
+	case "substr":
+		var length []interface{}
+		if len(args) > 2 {
+			length = args[2:3]
+		}
+		return substr(toString(arg(0)), toNumber(arg(1)), length)
+
+	case "merge":
+		out := make([]interface{}, 0, len(args))
+		for _, a := range args {
+			if list, ok := a.([]interface{}); ok {
+				out = append(out, list...)
+			} else {
+				out = append(out, a)
+			}
+		}
+		return out
+	case "missing":
+		// The names may come from another operator, e.g. {"missing": {"merge": ...}}
+		names := args
+		if len(args) == 1 {
+			if list, ok := args[0].([]interface{}); ok {
+				names = list
+			}
+		}
+		return missing(s, names)
+	case "missing_some":
+		names, _ := arg(1).([]interface{})
+		absent := missing(s, names)
+		if int(toNumber(arg(0))) > len(names)-len(absent) {
+			return absent
+		}
+		return []interface{}{}
+
+	case "+":
+		sum := 0.0
+		for _, a := range args {
+			sum += toNumber(a)
+		}
+		return sum
+	case "*":
+		product := 1.0
+		for _, a := range args {
+			product *= toNumber(a)
+		}
+		return product
+	case "-":
+		if len(args) == 1 {
+			return -toNumber(args[0])
+		}
+		return toNumber(arg(0)) - toNumber(arg(1))
+	case "/":
+		return toNumber(arg(0)) / toNumber(arg(1))
+	case "%":
+		return math.Mod(toNumber(arg(0)), toNumber(arg(1)))
+	case "abs":
+		return math.Abs(toNumber(arg(0)))
+	case "min", "max":
+		if len(args) == 0 {
+			return nil
+		}
+		nums := make([]float64, len(args))
+		for i, a := range args {
+			nums[i] = toNumber(a)
+		}
+		sort.Float64s(nums)
+		if op == "min" {
+			return nums[0]
+		}
+		return nums[len(nums)-1]
+	}
+	return nil
+}
+
+// substr takes length runes from start; a negative start counts from the
+// end and a negative length stops that many runes before the end
+func substr(str string, start float64, length []interface{}) string {
+	runes := []rune(str)
+	from := int(start)
+	if from < 0 {
+		from += len(runes)
+	}
+	if from < 0 || from > len(runes) {
+		return str
+	}
+
+	to := len(runes)
+	if len(length) > 0 {
+		if n := int(toNumber(length[0])); n < 0 {
+			to = len(runes) + n
+		} else {
+			to = from + n
+		}
+	}
+	to = min(to, len(runes))
+	if to < from {
+		return ""
+	}
+	return string(runes[from:to])
+}
+
+// missing returns the variable names that are absent or null
+func missing(s *scope, names []interface{}) []interface{} {
+	absent := []interface{}{}
+	for _, name := range names {
+		if v, ok := lookup(s.data, toString(name)); !ok || v == nil {
+			absent = append(absent, name)
+		}
+	}
+	return absent
+}
+
+// truthy follows JavaScript: false, null, 0, "" and [] are falsy
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0 && !math.IsNaN(t)
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+func toNumber(v interface{}) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case int:
+		return float64(t)
+	case bool:
+		if t {
+			return 1
+		}
+		return 0
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	case nil:
+		return 0
+	}
+	return math.NaN()
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// looseEquals mirrors JavaScript ==: null only equals null, numbers and
+// numeric strings compare by value, everything else must match exactly.
+func looseEquals(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	as, aIsString := a.(string)
+	bs, bIsString := b.(string)
+	if aIsString && bIsString {
+		return as == bs
+	}
+	if isScalar(a) && isScalar(b) {
+		return toNumber(a) == toNumber(b)
+	}
+	return false
+}
+
+func strictEquals(a, b interface{}) bool {
+	switch at := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		bt, ok := b.(float64)
+		return ok && at == bt
+	case string:
+		bt, ok := b.(string)
+		return ok && at == bt
+	case bool:
+		bt, ok := b.(bool)
+		return ok && at == bt
+	}
+	return false
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case float64, int, string, bool:
+		return true
+	}
+	return false
+}
+
+// compare implements <, <=, > and >= the way the library does: a <= b is
+// a < b or a == b, so null <= 0 is false even though null < 1 is true.
+func compare(op string, a, b interface{}) bool {
+	switch op {
+	case "<":
+		return less(a, b)
+	case "<=":
+		return less(a, b) || looseEquals(a, b)
+	case ">":
+		return less(b, a)
+	case ">=":
+		return less(b, a) || looseEquals(b, a)
+	}
+	return false
+}
+
+// less mirrors JavaScript <: strings compare lexically with each other,
+// everything else numerically with null as 0. NaN never compares true.
+func less(a, b interface{}) bool {
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return as < bs
+		}
+	}
+	return toNumber(a) < toNumber(b)
+}
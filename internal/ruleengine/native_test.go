@@ -0,0 +1,170 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// parityRules cover every operator the native evaluator implements plus
+// ones it hands to the library, nested inside native operators
+var parityRules = []json.RawMessage{
+	json.RawMessage(`{"<=": [10, {"var": "orders_23d"}, 30]}`),
+	json.RawMessage(`{"!=": [{"%": [{"var": "order_count_total"}, 3]}, 0]}`),
+	json.RawMessage(`{"==": [{"var": "attr.tier"}, null]}`),
+	json.RawMessage(`{"if": [{"in": ["d", {"var": "location_tag"}]}, true, {">": [{"var": "ltv"}, 8000]}]}`),
+	json.RawMessage(`{"==": [{"cat": [" at ", {"var": "location_tag"}]}, "at blr"]}`),
+	json.RawMessage(`{"==": [{"substr": [{"var": "location_tag"}, 1]}, "lr"]}`),
+	json.RawMessage(`{"==": [{"substr": [{"var": "location_tag"}, -2]}, "el"]}`),
+	json.RawMessage(`{"==": [{"substr": [{"var": "location_tag"}, 0, -1]}, "hy"]}`),
+	json.RawMessage(`{">": [{"abs": {"-": [{"var": "ltv"}, 4500]}}, 2000]}`),
+	json.RawMessage(`{"in": ["gold", {"merge": [{"var": "attr.tier"}, ["silver"]]}]}`),
+	json.RawMessage(`{"!": {"missing": ["attr.tier"]}}`),
+	json.RawMessage(`{"!": {"missing": {"merge": ["ltv", "attr.tier"]}}}`),
+	json.RawMessage(`{"!": {"missing_some": [2, ["attr.tier", "ltv", "attr.plan"]]}}`),
+	json.RawMessage(`{"and": [{">": [{"var": "orders_23d"}, 5]}, {"some": [["blr", "del"], {"==": [{"var": ""}, "del"]}]}]}`),
+	json.RawMessage(`{"<": [{"reduce": [{"merge": [{"var": "orders_23d"}, {"var": "order_count_total"}]}, {"+": [{"var": "current"}, {"var": "accumulator"}]}, 0]}, 100]}`),
+	json.RawMessage(`{"or": [{"all": [{"merge": [{"var": "orders_23d"}, {"var": "order_count_total"}]}, {">": [{"var": ""}, 20]}]}, {"==": [{"var": "location_tag"}, "bom"]}]}`),
+	json.RawMessage(`{"and": [{"none": [[1, 2], {">": [{"var": ""}, 5]}]}, {"<": [{"var": "orders_23d"}, 20]}]}`),
+}
+
+func TestNativeMatchesJSONLogic(t *testing.T) {
+	users := sampleUsers(300)
+	for _, raw := range parityRules {
+		rule, err := Compile(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+		matched := 0
+		for _, data := range users {
+			want := applyJSONLogic(t, raw, data)
+			got, err := rule.Match(data)
+			if err != nil {
+				t.Fatalf("%s: %v", raw, err)
+			}
+			if got != want {
+				t.Fatalf("%s on %v: native=%v jsonlogic=%v", raw, data, got, want)
+			}
+			if got {
+				matched++
+			}
+		}
+		// Constant rules cannot tell a broken operator from a working one
+		if matched == 0 || matched == len(users) {
+			t.Errorf("%s matched %d of %d users", raw, matched, len(users))
+		}
+	}
+}
+
+// Ordering comparisons read null as 0 like the library, so stored rules
+// over users who never ordered, or over missing attributes, keep matching
+func TestNullComparisonsMatchJSONLogic(t *testing.T) {
+	neverOrdered := BuildContext(domain.UserMetrics{UserID: "U1", LocationTag: "unknown"}, nil, time.Now())
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`{"<": [{"var": "days_since_last_order"}, 7]}`, true},
+		{`{">": [1, {"var": "last_order_at"}]}`, true},
+		{`{"<": [-1, {"var": "days_since_last_order"}, 7]}`, true},
+		{`{"<": [{"var": "attr.missing"}, 1]}`, true},
+		{`{">": [{"var": "attr.missing"}, -1]}`, true},
+		{`{">=": [{"var": "attr.missing"}, -1]}`, true},
+		{`{">": [{"var": "attr.missing"}, 0]}`, false},
+		// <= is < or ==, and null only equals null
+		{`{"<=": [{"var": "attr.missing"}, 0]}`, false},
+		{`{">=": [{"var": "attr.missing"}, 0]}`, false},
+		{`{"<=": [{"var": "attr.missing"}, 5]}`, true},
+		{`{"<=": [null, null]}`, true},
+		{`{">": [5, {"var": "attr.missing"}, -1]}`, true},
+		{`{">": [5, {"var": "attr.missing"}, 0]}`, false},
+		{`{">": [5, 2, {"var": "attr.missing"}]}`, true},
+		{`{">=": [5, 0, {"var": "attr.missing"}]}`, false},
+	}
+	for _, tt := range tests {
+		raw := json.RawMessage(tt.rule)
+		if got := applyJSONLogic(t, raw, neverOrdered); got != tt.want {
+			t.Errorf("%s: jsonlogic says %v, want %v", tt.rule, got, tt.want)
+		}
+		if got, err := Evaluate(raw, neverOrdered); err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.rule, got, err, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	data := map[string]interface{}{
+		"n":    3.0,
+		"name": "daffodil",
+		"attr": map[string]interface{}{"tier": "gold", "plan": nil},
+	}
+	tests := []struct {
+		rule string
+		want interface{}
+	}{
+		{`{"substr": ["daffodil", 3]}`, "fodil"},
+		{`{"substr": ["daffodil", -3]}`, "dil"},
+		{`{"substr": ["daffodil", 1, 3]}`, "aff"},
+		{`{"substr": ["daffodil", 1, -3]}`, "affo"},
+		{`{"substr": ["daffodil", 20]}`, "daffodil"},
+		{`{"substr": ["daffodil", 6, 10]}`, "il"},
+		{`{"merge": [1, [2, 3], [[4]]]}`, []interface{}{1.0, 2.0, 3.0, []interface{}{4.0}}},
+		{`{"merge": "a"}`, []interface{}{"a"}},
+		{`{"missing": ["n", "attr.tier", "attr.plan", "x"]}`, []interface{}{"attr.plan", "x"}},
+		{`{"missing": "n"}`, []interface{}{}},
+		{`{"missing_some": [1, ["x", "n"]]}`, []interface{}{}},
+		{`{"missing_some": [2, ["x", "n"]]}`, []interface{}{"x"}},
+		{`{"abs": -2.5}`, 2.5},
+		{`{"cat": ["a", " ", "b "]}`, "a b"},
+		{`{"cat": " a "}`, " a "},
+		{`{"filter": [[1, 2, 3, 4], {">": [{"var": ""}, 2]}]}`, []interface{}{3.0, 4.0}},
+		{`{"map": [[1, 2], {"*": [{"var": ""}, 2]}]}`, []interface{}{2.0, 4.0}},
+	}
+	for _, tt := range tests {
+		rule, err := Compile(json.RawMessage(tt.rule))
+		if err != nil {
+			t.Errorf("%s: %v", tt.rule, err)
+			continue
+		}
+		s := &scope{data: data}
+		if got := rule.root.eval(s); !reflect.DeepEqual(got, tt.want) || s.err != nil {
+			t.Errorf("%s = %#v (err %v), want %#v", tt.rule, got, s.err, tt.want)
+		}
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{`{"nope": [1]}`, `unknown operator "nope"`},
+		{`{"var": {"a": 1}}`, "var name must be a string"},
+		{`{"in_segment": ""}`, "in_segment takes one segment name"},
+		{`{"some": [[1], {"in_segment": "vip"}]}`, `in_segment cannot be used inside "some"`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(json.RawMessage(tt.rule))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+}
+
+func TestMatchReportsLibraryErrors(t *testing.T) {
+	raw := json.RawMessage(`{"==": [{"reduce": [[1], {"var": "current"}, null]}, 1]}`)
+	rule, err := Compile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rule.Match(map[string]interface{}{}); ok || err == nil {
+		t.Errorf("Match = %v, %v; want an error", ok, err)
+	}
+	if err := Validate(raw); err == nil {
+		t.Error("Validate accepted a rule that cannot evaluate")
+	}
+}
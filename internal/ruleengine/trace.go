@@ -0,0 +1,185 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace records how one sub-expression of a rule evaluated. Expr is the
+// sub-expression in the rule DSL; Passed is whether its value is truthy.
+// Operands that were never evaluated because and/or short-circuited are
+// marked Skipped.
+type Trace struct {
+	Expr     string      `json:"expr"`
+	Op       string      `json:"op,omitempty"`
+	Value    interface{} `json:"value"`
+	Passed   bool        `json:"passed"`
+	Skipped  bool        `json:"skipped,omitempty"`
+	Children []*Trace    `json:"children,omitempty"`
+}
+
+// Explanation is the answer to "why is (or isn't) this user in the segment"
+type Explanation struct {
+	Matched bool `json:"matched"`
+	// FailedClauses are the innermost conditions that made the rule false,
+	// with the values of the variables they read.
+	FailedClauses []string `json:"failed_clauses"`
+	Trace         *Trace   `json:"trace"`
+	// Error is why the rule could not be evaluated, which MatchWith reports
+	// as no match
+	Error string `json:"error,omitempty"`
+}
+
+// Explain evaluates the rule like MatchWith, recording every sub-expression.
+// It is much slower than Match and meant for debugging single users.
+func (r *Rule) Explain(data map[string]interface{}, segments map[string]bool) *Explanation {
+	s := &scope{data: data, segments: segments}
+	root := trace(r.root, s)
+	e := &Explanation{Matched: root.Value == true && s.err == nil, FailedClauses: []string{}, Trace: root}
+	if s.err != nil {
+		e.Error = s.err.Error()
+	}
+	if !e.Matched {
+		collectFailures(root, &e.FailedClauses)
+	}
+	return e
+}
+
+func trace(n node, s *scope) *Trace {
+	t := &Trace{Expr: describe(n)}
+
+	op, ok := n.(opNode)
+	if !ok {
+		t.Value = n.eval(s)
+		t.Passed = truthy(t.Value)
+		return t
+	}
+	t.Op = op.op
+
+	// and, or and if only evaluate what they need; mirror opNode.eval so
+	// the trace shows the same short-circuiting
+	switch op.op {
+	case "and", "or":
+		var last interface{} = false
+		done := false
+		for _, a := range op.args {
+			if done {
+				t.Children = append(t.Children, &Trace{Expr: describe(a), Skipped: true})
+				continue
+			}
+			child := trace(a, s)
+			t.Children = append(t.Children, child)
+			last = child.Value
+			if truthy(last) == (op.op == "or") {
+				done = true
+			}
+		}
+		t.Value = last
+
+	case "if", "?:":
+		t.Value = nil
+		i := 0
+		decided := false
+		for ; i+1 < len(op.args); i += 2 {
+			if decided {
+				t.Children = append(t.Children, &Trace{Expr: describe(op.args[i]), Skipped: true}, &Trace{Expr: describe(op.args[i+1]), Skipped: true})
+				continue
+			}
+			cond := trace(op.args[i], s)
+			t.Children = append(t.Children, cond)
+			if cond.Passed {
+				branch := trace(op.args[i+1], s)
+				t.Children = append(t.Children, branch)
+				t.Value = branch.Value
+				decided = true
+			} else {
+				t.Children = append(t.Children, &Trace{Expr: describe(op.args[i+1]), Skipped: true})
+			}
+		}
+		if i < len(op.args) {
+			if decided {
+				t.Children = append(t.Children, &Trace{Expr: describe(op.args[i]), Skipped: true})
+			} else {
+				branch := trace(op.args[i], s)
+				t.Children = append(t.Children, branch)
+				t.Value = branch.Value
+			}
+		}
+
+	default:
+		args := make([]interface{}, len(op.args))
+		for i, a := range op.args {
+			child := trace(a, s)
+			t.Children = append(t.Children, child)
+			args[i] = child.Value
+		}
+		t.Value = apply(s, op.op, args)
+	}
+
+	t.Passed = truthy(t.Value)
+	return t
+}
+
+// describe renders a node in the DSL, falling back to its operator for
+// expressions the DSL cannot show
+func describe(n node) string {
+	if s, _, err := format(n); err == nil {
+		return s
+	}
+	switch t := n.(type) {
+	case opNode:
+		return t.op + "(...)"
+	case libraryNode:
+		return t.op + "(...)"
+	}
+	return fmt.Sprintf("%v", n)
+}
+
+// collectFailures walks down a false trace to the conditions responsible:
+// the operand that stopped an and, every operand of a failed or, and
+// otherwise the condition itself.
+func collectFailures(t *Trace, out *[]string) {
+	switch t.Op {
+	case "and":
+		for _, c := range t.Children {
+			if !c.Skipped && !c.Passed {
+				collectFailures(c, out)
+				return
+			}
+		}
+	case "or":
+		for _, c := range t.Children {
+			collectFailures(c, out)
+		}
+		return
+	}
+	*out = append(*out, t.Expr+withValues(t))
+}
+
+// withValues lists the variables a condition read, e.g. " (orders_23d = 3)"
+func withValues(t *Trace) string {
+	var vars []string
+	seen := map[string]bool{}
+	var walk func(*Trace)
+	walk = func(t *Trace) {
+		if t.Op == "" && !t.Skipped && identPattern.MatchString(t.Expr) && !dslKeywords[t.Expr] && !seen[t.Expr] {
+			seen[t.Expr] = true
+			vars = append(vars, fmt.Sprintf("%s = %s", t.Expr, describeValue(t.Value)))
+		}
+		for _, c := range t.Children {
+			walk(c)
+		}
+	}
+	walk(t)
+	if len(vars) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(vars, ", ") + ")"
+}
+
+func describeValue(v interface{}) string {
+	if s, _, err := formatLiteral(v); err == nil {
+		return s
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,129 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	data := map[string]interface{}{"orders_23d": 3.0, "ltv": 50.0, "location_tag": "Sylhet"}
+	vip := map[string]bool{"vip": true}
+
+	tests := []struct {
+		name     string
+		rule     string
+		segments map[string]bool
+		matched  bool
+		failed   []string
+	}{
+		{
+			name:    "and stops at the first false operand",
+			rule:    `orders_23d > 1 and ltv > 100 and location_tag == "Dhaka"`,
+			matched: false,
+			failed:  []string{"ltv > 100 (ltv = 50)"},
+		},
+		{
+			name:    "every operand of a failed or",
+			rule:    "orders_23d > 5 or ltv > 1000",
+			matched: false,
+			failed:  []string{"orders_23d > 5 (orders_23d = 3)", "ltv > 1000 (ltv = 50)"},
+		},
+		{
+			name:    "or inside and",
+			rule:    `(orders_23d > 5 or ltv > 1000) and location_tag == "Dhaka"`,
+			matched: false,
+			failed:  []string{"orders_23d > 5 (orders_23d = 3)", "ltv > 1000 (ltv = 50)"},
+		},
+		{
+			name:    "or that passes",
+			rule:    "orders_23d > 5 or ltv > 10",
+			matched: true,
+			failed:  []string{},
+		},
+		{
+			name:     "in a segment",
+			rule:     `in_segment("vip") and orders_23d > 1`,
+			segments: vip,
+			matched:  true,
+			failed:   []string{},
+		},
+		{
+			name:    "not in a segment",
+			rule:    `in_segment("vip") and orders_23d > 1`,
+			matched: false,
+			failed:  []string{`in_segment("vip")`},
+		},
+		{
+			name:     "excluded by a segment",
+			rule:     `not in_segment("vip")`,
+			segments: vip,
+			matched:  false,
+			failed:   []string{`not in_segment("vip")`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := CompileDSL(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, err := Compile(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := rule.Explain(data, tt.segments)
+			if e.Matched != tt.matched {
+				t.Errorf("matched = %v, want %v", e.Matched, tt.matched)
+			}
+			if ok, _ := rule.MatchWith(data, tt.segments); ok != e.Matched {
+				t.Errorf("MatchWith = %v, Explain = %v", ok, e.Matched)
+			}
+			if !reflect.DeepEqual(e.FailedClauses, tt.failed) {
+				t.Errorf("failed clauses = %q, want %q", e.FailedClauses, tt.failed)
+			}
+			if e.Trace.Expr != tt.rule || e.Error != "" {
+				t.Errorf("trace of %q, error %q", e.Trace.Expr, e.Error)
+			}
+		})
+	}
+}
+
+func TestExplainMarksSkippedOperands(t *testing.T) {
+	raw, err := CompileDSL(`ltv > 100 and orders_23d > 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := Compile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := rule.Explain(map[string]interface{}{"ltv": 50.0, "orders_23d": 3.0}, nil)
+	children := e.Trace.Children
+	if len(children) != 2 || children[0].Skipped || children[0].Passed || !children[1].Skipped {
+		t.Fatalf("children = %+v", children)
+	}
+	if children[0].Value != false || children[0].Children[0].Value != 50.0 {
+		t.Errorf("ltv > 100 traced as %+v", children[0])
+	}
+}
+
+func TestExplainReportsEvaluationErrors(t *testing.T) {
+	// Both fail the same way; != would pass on the value alone
+	for _, raw := range []string{
+		`{"==": [{"reduce": [[1], {"var": "current"}, null]}, 1]}`,
+		`{"!=": [{"reduce": [[1], {"var": "current"}, null]}, 1]}`,
+	} {
+		rule, err := Compile(json.RawMessage(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := rule.Explain(map[string]interface{}{}, nil)
+		if e.Matched || !strings.Contains(e.Error, "reduce") {
+			t.Errorf("%s: matched = %v, error %q; want no match and the reduce error", raw, e.Matched, e.Error)
+		}
+	}
+}
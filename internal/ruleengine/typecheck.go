@@ -0,0 +1,253 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Types the checker infers besides the catalog's number and string
+const (
+	TypeBoolean VarType = "boolean"
+	TypeArray   VarType = "array"
+	typeNull    VarType = "null"
+	typeAny     VarType = "any" // not known until evaluation, e.g. custom attributes
+)
+
+// typeInfo is the inferred type of an expression; elem is the element type
+// of array literals so "in" can check membership tests.
+type typeInfo struct {
+	t    VarType
+	elem VarType
+}
+
+func known(t VarType) bool {
+	return t != typeAny && t != typeNull
+}
+
+// TypeCheck verifies a compiled rule against the variable catalog: every
+// variable must exist, and operators must not mix incompatible types, such as
+// comparing location_tag with a number. It catches rules that would
+// otherwise quietly evaluate to false for everyone.
+func TypeCheck(r *Rule) error {
+	_, err := check(r.root)
+	return err
+}
+
+func lookupVariable(name string) (Variable, bool) {
+	for _, v := range Catalog {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variable{}, false
+}
+
+func check(n node) (typeInfo, error) {
+	switch t := n.(type) {
+	case literal:
+		return typeInfo{t: valueType(t.value)}, nil
+
+	case arrayNode:
+		info := typeInfo{t: TypeArray, elem: typeNull}
+		for _, item := range t.items {
+			it, err := check(item)
+			if err != nil {
+				return typeInfo{}, err
+			}
+			switch {
+			case !known(it.t):
+			case info.elem == typeNull:
+				info.elem = it.t
+			case info.elem != it.t:
+				info.elem = typeAny
+			}
+		}
+		return info, nil
+
+	case varNode:
+		return checkVar(t)
+
+	case segmentRef:
+		return typeInfo{t: TypeBoolean}, nil
+
+	case opNode:
+		return checkOp(t)
+	}
+	// Library subtrees are not checked; their result is known at evaluation
+	return typeInfo{t: typeAny}, nil
+}
+
+func checkVar(v varNode) (typeInfo, error) {
+	if v.name == "" || strings.HasPrefix(v.name, AttributeNamespace+".") {
+		return typeInfo{t: typeAny}, nil
+	}
+	if variable, ok := lookupVariable(v.name); ok {
+		return typeInfo{t: variable.Type}, nil
+	}
+	if s := suggest(v.name); s != "" {
+		return typeInfo{}, fmt.Errorf("unknown variable %q (did you mean %q?)", v.name, s)
+	}
+	return typeInfo{}, fmt.Errorf("unknown variable %q", v.name)
+}
+
+func checkOp(n opNode) (typeInfo, error) {
+	args := make([]typeInfo, len(n.args))
+	for i, a := range n.args {
+		info, err := check(a)
+		if err != nil {
+			return typeInfo{}, err
+		}
+		args[i] = info
+	}
+
+	switch n.op {
+	case "<", "<=", ">", ">=":
+		max := 2
+		if n.op == "<" || n.op == "<=" {
+			max = 3
+		}
+		if len(args) < 2 || len(args) > max {
+			want := "2"
+			if max == 3 {
+				want = "2 or 3"
+			}
+			return typeInfo{}, fmt.Errorf("%q takes %s arguments, got %d", n.op, want, len(args))
+		}
+		var seen VarType
+		for _, a := range args {
+			if !known(a.t) {
+				continue
+			}
+			if a.t != TypeNumber && a.t != TypeString {
+				return typeInfo{}, fmt.Errorf("%q cannot compare a %s", n.op, a.t)
+			}
+			if seen != "" && seen != a.t {
+				return typeInfo{}, fmt.Errorf("%q cannot compare a %s with a %s", n.op, seen, a.t)
+			}
+			seen = a.t
+		}
+		return typeInfo{t: TypeBoolean}, nil
+
+	case "==", "!=", "===", "!==":
+		if len(args) != 2 {
+			return typeInfo{}, fmt.Errorf("%q takes 2 arguments, got %d", n.op, len(args))
+		}
+		if known(args[0].t) && known(args[1].t) && args[0].t != args[1].t {
+			return typeInfo{}, fmt.Errorf("%q compares a %s with a %s", n.op, args[0].t, args[1].t)
+		}
+		return typeInfo{t: TypeBoolean}, nil
+
+	case "in":
+		if len(args) != 2 {
+			return typeInfo{}, fmt.Errorf(`"in" takes 2 arguments, got %d`, len(args))
+		}
+		needle, haystack := args[0], args[1]
+		switch haystack.t {
+		case TypeArray:
+			if known(needle.t) && known(haystack.elem) && needle.t != haystack.elem {
+				return typeInfo{}, fmt.Errorf(`"in" looks for a %s in a list of %ss`, needle.t, haystack.elem)
+			}
+		case TypeString:
+			if known(needle.t) && needle.t != TypeString {
+				return typeInfo{}, fmt.Errorf(`"in" looks for a %s in a string`, needle.t)
+			}
+		case typeAny, typeNull:
+		default:
+			return typeInfo{}, fmt.Errorf(`"in" needs a list or a string, got a %s`, haystack.t)
+		}
+		return typeInfo{t: TypeBoolean}, nil
+
+	case "+", "-", "*", "/", "%", "min", "max":
+		for _, a := range args {
+			if known(a.t) && a.t != TypeNumber {
+				return typeInfo{}, fmt.Errorf("%q needs numbers, got a %s", n.op, a.t)
+			}
+		}
+		return typeInfo{t: TypeNumber}, nil
+
+	case "!", "!!":
+		return typeInfo{t: TypeBoolean}, nil
+
+	case "abs":
+		if len(args) != 1 {
+			return typeInfo{}, fmt.Errorf(`"abs" takes 1 argument, got %d`, len(args))
+		}
+		if known(args[0].t) && args[0].t != TypeNumber {
+			return typeInfo{}, fmt.Errorf(`"abs" needs a number, got a %s`, args[0].t)
+		}
+		return typeInfo{t: TypeNumber}, nil
+
+	case "cat":
+		return typeInfo{t: TypeString}, nil
+
+	case "substr":
+		if len(args) < 2 || len(args) > 3 {
+			return typeInfo{}, fmt.Errorf(`"substr" takes 2 or 3 arguments, got %d`, len(args))
+		}
+		for _, a := range args[1:] {
+			if known(a.t) && a.t != TypeNumber {
+				return typeInfo{}, fmt.Errorf(`"substr" needs numeric positions, got a %s`, a.t)
+			}
+		}
+		return typeInfo{t: TypeString}, nil
+
+	case "missing_some":
+		if len(args) != 2 {
+			return typeInfo{}, fmt.Errorf(`"missing_some" takes 2 arguments, got %d`, len(args))
+		}
+		return typeInfo{t: TypeArray, elem: TypeString}, nil
+
+	case "missing", "merge":
+		return typeInfo{t: TypeArray, elem: typeAny}, nil
+	}
+
+	// and, or, if: the result is one of the branches
+	return typeInfo{t: typeAny}, nil
+}
+
+func valueType(v interface{}) VarType {
+	switch v.(type) {
+	case nil:
+		return typeNull
+	case float64, int:
+		return TypeNumber
+	case string:
+		return TypeString
+	case bool:
+		return TypeBoolean
+	case []interface{}:
+		return TypeArray
+	}
+	return typeAny
+}
+
+// suggest returns the catalog variable closest to a misspelt name
+func suggest(name string) string {
+	best, bestDist := "", 4
+	for _, v := range Catalog {
+		if d := editDistance(name, v.Name); d < bestDist {
+			best, bestDist = v.Name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
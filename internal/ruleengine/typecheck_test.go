@@ -0,0 +1,54 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string // "" when the rule is valid
+	}{
+		{`{">": [{"var": "orders_23d"}, 5]}`, ""},
+		{`{"<": [0, {"var": "ltv"}, 100]}`, ""},
+		{`{"in": [{"var": "location_tag"}, ["blr", "del"]]}`, ""},
+		{`{"in": ["bl", {"var": "location_tag"}]}`, ""},
+		{`{"==": [{"var": "attr.tier"}, 3]}`, ""},
+		{`{"==": [{"var": "last_order_at"}, null]}`, ""},
+		{`{"and": [{"in_segment": "vip"}, {"!": {"var": "attr.churned"}}]}`, ""},
+		{`{"==": [{"substr": [{"var": "location_tag"}, 0, 2]}, "bl"]}`, ""},
+		{`{">": [{"abs": {"var": "ltv"}}, 10]}`, ""},
+		{`{"some": [{"var": "attr.tags"}, {"==": [{"var": ""}, "beta"]}]}`, ""},
+
+		{`{">": [{"var": "order_23d"}, 5]}`, `unknown variable "order_23d" (did you mean "orders_23d"?)`},
+		{`{"==": [{"var": "nothing_like_it"}, 5]}`, `unknown variable "nothing_like_it"`},
+		{`{">": [{"var": "location_tag"}, 5]}`, "cannot compare a string with a number"},
+		{`{"<": [1, 2, 3, 4]}`, `"<" takes 2 or 3 arguments, got 4`},
+		{`{"<=": [1]}`, `"<=" takes 2 or 3 arguments, got 1`},
+		{`{">": [3, 2, 1]}`, `">" takes 2 arguments, got 3`},
+		{`{">": [true, 1]}`, "cannot compare a boolean"},
+		{`{"==": [{"var": "ltv"}, "5000"]}`, "compares a number with a string"},
+		{`{"in": [{"var": "ltv"}, ["blr"]]}`, "looks for a number in a list of strings"},
+		{`{"in": [5, {"var": "location_tag"}]}`, "looks for a number in a string"},
+		{`{"in": ["a", 5]}`, "needs a list or a string"},
+		{`{"+": [{"var": "location_tag"}, 1]}`, "needs numbers, got a string"},
+		{`{"abs": "x"}`, "needs a number, got a string"},
+		{`{"substr": ["abc", "1"]}`, "needs numeric positions"},
+		{`{"missing_some": [1]}`, "takes 2 arguments, got 1"},
+	}
+	for _, tt := range tests {
+		rule, err := Compile(json.RawMessage(tt.rule))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rule, err)
+		}
+		err = TypeCheck(rule)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.rule, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: err = %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/rand"
+	"sort"
+
+	"daffodil-experimentation-platform/internal/ruleengine"
+)
+
+// DefaultSampleSize is how many matching user IDs a dry run returns by default
+const DefaultSampleSize = 20
+
+// LocationBreakdown is the dry-run result for one location_tag
+type LocationBreakdown struct {
+	Location string `json:"location_tag"`
+	Matched  int    `json:"matched"`
+	Total    int    `json:"total"`
+}
+
+// DryRunResult estimates a rule's audience
+type DryRunResult struct {
+	Matched       int                 `json:"matched"`
+	Total         int                 `json:"total"`
+	Percentage    float64             `json:"percentage"`
+	SampleUserIDs []string            `json:"sample_user_ids"`
+	ByLocation    []LocationBreakdown `json:"by_location"`
+}
+
+// DryRun evaluates a draft rule against every user the way Evaluate does,
+// but only counts matches; nothing is written to Redis. The sample is
+// drawn uniformly from all matches.
+func DryRun(ctx context.Context, db *sql.DB, raw json.RawMessage, sampleSize int) (*DryRunResult, error) {
+	rule, err := ruleengine.Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	// Saved segments are only evaluated when the draft references them
+	var segments []ruleengine.NamedRule
+	if len(rule.Dependencies()) > 0 {
+		if segments, err = LoadRules(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+	if sampleSize <= 0 {
+		sampleSize = DefaultSampleSize
+	}
+	return dryRun(rule, segments, sampleSize, func(fn func(string, map[string]interface{})) error {
+		return forEachUser(ctx, db, fn)
+	})
+}
+
+// dryRun counts the users each yields that match rule, evaluating segments
+// first only when there are any
+func dryRun(rule *ruleengine.Rule, segments []ruleengine.NamedRule, sampleSize int, each func(func(userID string, data map[string]interface{})) error) (*DryRunResult, error) {
+	result := &DryRunResult{SampleUserIDs: []string{}, ByLocation: []LocationBreakdown{}}
+	locations := make(map[string]*LocationBreakdown)
+
+	err := each(func(uID string, data map[string]interface{}) {
+		location, _ := data["location_tag"].(string)
+		loc, ok := locations[location]
+		if !ok {
+			loc = &LocationBreakdown{Location: location}
+			locations[location] = loc
+		}
+		result.Total++
+		loc.Total++
+
+		var memberships map[string]bool
+		if len(segments) > 0 {
+			_, memberships = ruleengine.MatchAll(segments, data)
+		}
+		if ok, _ := rule.MatchWith(data, memberships); !ok {
+			return
+		}
+		result.Matched++
+		loc.Matched++
+
+		// Reservoir sampling keeps the sample uniform without holding every match
+		if len(result.SampleUserIDs) < sampleSize {
+			result.SampleUserIDs = append(result.SampleUserIDs, uID)
+		} else if i := rand.Intn(result.Matched); i < sampleSize {
+			result.SampleUserIDs[i] = uID
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Total > 0 {
+		result.Percentage = 100 * float64(result.Matched) / float64(result.Total)
+	}
+	for _, loc := range locations {
+		result.ByLocation = append(result.ByLocation, *loc)
+	}
+	sort.Slice(result.ByLocation, func(i, j int) bool {
+		a, b := result.ByLocation[i], result.ByLocation[j]
+		if a.Matched != b.Matched {
+			return a.Matched > b.Matched
+		}
+		return a.Location < b.Location
+	})
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"daffodil-experimentation-platform/internal/ruleengine"
+)
+
+// usersOf yields users as dryRun's each
+func usersOf(users []userContext) func(func(string, map[string]interface{})) error {
+	return func(fn func(string, map[string]interface{})) error {
+		for _, u := range users {
+			fn(u.userID, u.data)
+		}
+		return nil
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	// 10 users: U0-U5 in Dhaka, U6-U8 in Sylhet, U9 with no location. ltv
+	// is 100 * the user's number.
+	var users []userContext
+	for i := 0; i < 10; i++ {
+		data := map[string]interface{}{"ltv": float64(100 * i)}
+		switch {
+		case i < 6:
+			data["location_tag"] = "Dhaka"
+		case i < 9:
+			data["location_tag"] = "Sylhet"
+		}
+		users = append(users, userContext{userID: fmt.Sprintf("U%d", i), data: data})
+	}
+	segments := rules(t, "vip", "ltv >= 500")
+
+	tests := []struct {
+		name       string
+		rule       string
+		segments   []ruleengine.NamedRule
+		sampleSize int
+		matched    int
+		percentage float64
+		byLocation []LocationBreakdown
+	}{
+		{
+			name:       "by location",
+			rule:       "ltv >= 400",
+			sampleSize: 20,
+			matched:    6,
+			percentage: 60,
+			byLocation: []LocationBreakdown{
+				{Location: "Sylhet", Matched: 3, Total: 3},
+				{Location: "Dhaka", Matched: 2, Total: 6},
+				{Location: "", Matched: 1, Total: 1},
+			},
+		},
+		{
+			name:       "sample is capped",
+			rule:       "ltv >= 0",
+			sampleSize: 4,
+			matched:    10,
+			percentage: 100,
+			byLocation: []LocationBreakdown{
+				{Location: "Dhaka", Matched: 6, Total: 6},
+				{Location: "Sylhet", Matched: 3, Total: 3},
+				{Location: "", Matched: 1, Total: 1},
+			},
+		},
+		{
+			name:       "no matches",
+			rule:       "ltv > 1000",
+			sampleSize: 20,
+			byLocation: []LocationBreakdown{
+				{Location: "", Matched: 0, Total: 1},
+				{Location: "Dhaka", Matched: 0, Total: 6},
+				{Location: "Sylhet", Matched: 0, Total: 3},
+			},
+		},
+		{
+			name:       "saved segments",
+			rule:       `in_segment("vip") and location_tag == "Dhaka"`,
+			segments:   segments,
+			sampleSize: 20,
+			matched:    1,
+			percentage: 10,
+			byLocation: []LocationBreakdown{
+				{Location: "Dhaka", Matched: 1, Total: 6},
+				{Location: "", Matched: 0, Total: 1},
+				{Location: "Sylhet", Matched: 0, Total: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := ruleengine.CompileDSL(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, err := ruleengine.Compile(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := dryRun(rule, tt.segments, tt.sampleSize, usersOf(users))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Total != len(users) || result.Matched != tt.matched || result.Percentage != tt.percentage {
+				t.Errorf("%d of %d matched (%v%%), want %d of %d (%v%%)",
+					result.Matched, result.Total, result.Percentage, tt.matched, len(users), tt.percentage)
+			}
+			if !reflect.DeepEqual(result.ByLocation, tt.byLocation) {
+				t.Errorf("by location = %+v, want %+v", result.ByLocation, tt.byLocation)
+			}
+
+			wantSample := tt.matched
+			if wantSample > tt.sampleSize {
+				wantSample = tt.sampleSize
+			}
+			if len(result.SampleUserIDs) != wantSample {
+				t.Errorf("sample = %v, want %d users", result.SampleUserIDs, wantSample)
+			}
+			seen := make(map[string]bool)
+			for _, id := range result.SampleUserIDs {
+				if seen[id] {
+					t.Errorf("%s sampled twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultBatchSize is how many users a full evaluation loads, evaluates and
+// writes to Redis at a time
+const DefaultBatchSize = 1000
+
+// lastRunKey is a Redis hash describing the last evaluation: the
+// fingerprint of the rules it used and when it started
+const lastRunKey = "evaluation:last_run"
+
+// EvaluationJobKind is the jobs.Job kind of an Evaluate run
+const EvaluationJobKind = "evaluation"
+
+const (
+	// evaluationLockKey keeps evaluations and segment jobs from running at
+	// the same time, which would race on the caches, the dirty flags and
+	// lastRunKey. The worker's writes for single users do not take it;
+	// writeUsers keeps every writer from caching older data over newer.
+	evaluationLockKey = "evaluation:lock"
+	evaluationLockTTL = 30 * time.Second
+	// evaluationLockRetry is how often WaitEvaluationLock tries again
+	evaluationLockRetry = time.Second
+)
+
+// LockEvaluation takes the lock that callers of Evaluate hold for the whole
+// run. owner names the caller, e.g. a job ID, and must be unique to it. It
+// returns jobs.ErrLocked when another evaluation is running.
+func LockEvaluation(ctx context.Context, rdb *redis.Client, owner string) (*jobs.Lock, error) {
+	return jobs.Acquire(ctx, rdb, evaluationLockKey, owner, evaluationLockTTL)
+}
+
+// WaitEvaluationLock is LockEvaluation for work that must run after the
+// current evaluation instead of being skipped, such as a segment job. It
+// waits until the lock is free or ctx is done.
+func WaitEvaluationLock(ctx context.Context, rdb *redis.Client, owner string) (*jobs.Lock, error) {
+	return jobs.AcquireWait(ctx, rdb, evaluationLockKey, owner, evaluationLockTTL, evaluationLockRetry)
+}
+
+// EvaluationLockHolder returns the owner of the running evaluation, or ""
+func EvaluationLockHolder(ctx context.Context, rdb *redis.Client) (string, error) {
+	return jobs.Holder(ctx, rdb, evaluationLockKey)
+}
+
+// EvaluationOptions tune a full re-evaluation; zero values pick defaults
+type EvaluationOptions struct {
+	Workers   int // goroutines evaluating batches, default GOMAXPROCS
+	BatchSize int // users per page and per Redis pipeline, default DefaultBatchSize
+	// Incremental evaluates only the users marked dirty since they were
+	// last evaluated, unless the live segments, experiments or feature
+	// strategies changed since the last run, in which case everyone is.
+	Incremental bool
+	// Progress, if set, is called with the running totals once the users
+	// due are counted and after every batch is written. Calls never overlap.
+	Progress func(EvaluationStats)
+}
+
+// EvaluationStats are the running totals of a full re-evaluation
+type EvaluationStats struct {
+	Full           bool    `json:"full"`  // every user, rather than only dirty ones
+	Total          int64   `json:"total"` // users due, counted when the run starts
+	Users          int64   `json:"users"`
+	Memberships    int64   `json:"memberships"` // segment memberships written
+	Errors         int64   `json:"errors"`      // users whose cache could not be written
+	Batches        int64   `json:"batches"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	UsersPerSecond float64 `json:"users_per_second"`
+}
+
+// userContext is one user's rule context, built from their data at version
+type userContext struct {
+	userID  string
+	version int64
+	data    map[string]interface{}
+}
+
+// evaluation is what the goroutines of one full run share
+type evaluation struct {
+	rdb      *redis.Client
+	metrics  repository.MetricsRepository
+	full     bool
+	total    int64
+	segments []ruleengine.NamedRule
+	payloads *payloadSource
+	progress func(EvaluationStats)
+	start    time.Time
+
+	users, memberships, failed, batches atomic.Int64
+	progressMu                          sync.Mutex
+}
+
+// Evaluate re-evaluates every user, or with opts.Incremental only the dirty
+// ones, against the live segments and rewrites their cached memberships
+// and payloads. Callers hold the lock from LockEvaluation.
+//
+// One goroutine pages through user_metrics by user_id, loading each page's
+// attributes in a single query, while opts.Workers goroutines evaluate the
+// pages and write each one to Redis in a single transaction. Evaluated
+// users are no longer dirty. Users whose writes fail are counted in the
+// stats and marked dirty, and the run carries on; failing to read users
+// stops it, and the stats so far are returned with the error.
+func Evaluate(ctx context.Context, db *sql.DB, rdb *redis.Client, opts EvaluationOptions) (*EvaluationStats, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+
+	// Everything but the users is loaded once for the whole run
+	segments, err := LoadRules(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	payloads, err := loadPayloadSource(ctx, db, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything that changes what a user would get means everyone is due
+	fingerprint := rulesFingerprint(segments, payloads)
+	start := time.Now()
+	metrics := repository.NewPostgresMetricsRepository(db)
+	full := true
+	if opts.Incremental {
+		last, err := rdb.HGetAll(ctx, lastRunKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		lastStart, err := time.Parse(time.RFC3339Nano, last["started_at"])
+		if err == nil && last["fingerprint"] == fingerprint {
+			full = false
+			// days_since_last_order moves on with nobody writing anything
+			if _, err := metrics.MarkDaysElapsed(ctx, lastStart, start); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	total, err := metrics.Count(ctx, !full)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &evaluation{
+		rdb:      rdb,
+		metrics:  metrics,
+		full:     full,
+		total:    total,
+		segments: segments,
+		payloads: payloads,
+		progress: opts.Progress,
+		start:    start,
+	}
+	if e.progress != nil {
+		e.progress(e.stats())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make(chan []userContext, opts.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pages {
+				e.evaluatePage(ctx, page)
+			}
+		}()
+	}
+
+	err = pageUsers(ctx, db, opts.BatchSize, !full, func(page []userContext) error {
+		select {
+		case pages <- page:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(pages)
+	wg.Wait()
+
+	stats := e.stats()
+	if err != nil {
+		return &stats, err
+	}
+	err = rdb.HSet(ctx, lastRunKey, "fingerprint", fingerprint, "started_at", start.UTC().Format(time.RFC3339Nano)).Err()
+	return &stats, err
+}
+
+// rulesFingerprint identifies everything besides a user's own data that
+// decides their memberships and payload
+func rulesFingerprint(segments []ruleengine.NamedRule, payloads *payloadSource) string {
+	var parts []string
+	for _, s := range segments {
+		parts = append(parts, fmt.Sprintf("segment %s v%d", s.ID, s.Version))
+	}
+	for _, experiments := range payloads.experiments {
+		for _, e := range experiments {
+			parts = append(parts, "experiment "+e.ID)
+		}
+	}
+	for key, strategy := range payloads.strategies {
+		parts = append(parts, fmt.Sprintf("strategy %s %s", key, strategy))
+	}
+	sort.Strings(parts)
+
+	h := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// evaluatePage matches one page of users and writes all of them in one
+// Redis transaction. Users the worker already re-evaluated from newer data
+// are left as they are.
+func (e *evaluation) evaluatePage(ctx context.Context, page []userContext) {
+	// Match everyone up front; writeUsers may queue a user's writes again
+	matched := make(map[string][]ruleengine.NamedRule, len(page))
+	for _, u := range page {
+		matched[u.userID], _ = ruleengine.MatchAll(e.segments, u.data)
+	}
+
+	done, failed, _, err := writeUsers(ctx, e.rdb, page, func(pipe redis.Pipeliner, u userContext) {
+		features, sources := e.payloads.resolve(u.userID, segmentIDs(matched[u.userID]))
+		writeUser(ctx, pipe, u.userID, matched[u.userID], features, sources)
+	})
+	if err != nil {
+		log.Printf("❌ Failed to write %d users: %v", len(failed), err)
+	}
+	memberships := 0
+	for userID := range done {
+		memberships += len(matched[userID])
+	}
+
+	// Use a fresh context so the flags match Redis even if the run is
+	// cancelled part way
+	flagCtx := context.WithoutCancel(ctx)
+	if err := e.metrics.ClearDirty(flagCtx, done); err != nil {
+		log.Printf("❌ Failed to clear dirty flags: %v", err)
+	}
+	if err := e.metrics.MarkDirty(flagCtx, failed); err != nil {
+		log.Printf("❌ Failed to mark %d users dirty: %v", len(failed), err)
+	}
+
+	e.users.Add(int64(len(page)))
+	e.memberships.Add(int64(memberships))
+	e.failed.Add(int64(len(failed)))
+	e.batches.Add(1)
+
+	if e.progress != nil {
+		e.progressMu.Lock()
+		e.progress(e.stats())
+		e.progressMu.Unlock()
+	}
+}
+
+func (e *evaluation) stats() EvaluationStats {
+	s := EvaluationStats{
+		Full:           e.full,
+		Total:          e.total,
+		Users:          e.users.Load(),
+		Memberships:    e.memberships.Load(),
+		Errors:         e.failed.Load(),
+		Batches:        e.batches.Load(),
+		ElapsedSeconds: time.Since(e.start).Seconds(),
+	}
+	if s.ElapsedSeconds > 0 {
+		s.UsersPerSecond = float64(s.Users) / s.ElapsedSeconds
+	}
+	return s
+}
+
+// payloadSource resolves users' payloads from the live experiments and
+// feature strategies, loaded once for a bulk evaluation
+type payloadSource struct {
+	experiments map[string][]domain.Experiment // by segment ID
+	strategies  map[string]domain.MergeStrategy
+}
+
+func loadPayloadSource(ctx context.Context, db *sql.DB, segments []ruleengine.NamedRule) (*payloadSource, error) {
+	experiments, err := repository.NewPostgresExperimentRepository(db).ListForSegmentIDs(ctx, segmentIDs(segments))
+	if err != nil {
+		return nil, err
+	}
+	strategies, err := repository.NewPostgresFeatureStrategyRepository(db).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &payloadSource{experiments: make(map[string][]domain.Experiment), strategies: strategies}
+	for _, exp := range experiments {
+		p.experiments[exp.SegmentID] = append(p.experiments[exp.SegmentID], exp)
+	}
+	return p, nil
+}
+
+// resolve builds the payload of a user in the given segments
+func (p *payloadSource) resolve(userID string, segmentIDs []string) (map[string]interface{}, map[string]*FeatureExplanation) {
+	var experiments []domain.Experiment
+	for _, id := range segmentIDs {
+		experiments = append(experiments, p.experiments[id]...)
+	}
+	return ResolveFeatures(AssignVariants(userID, experiments), p.strategies)
+}
+
+// pageUsers walks user_metrics, or only the dirty users, a page at a time
+// in user_id order, loading each page's attributes in one query, and calls
+// fn with the page's rule contexts. It stops at the first error, including
+// one from fn.
+func pageUsers(ctx context.Context, db *sql.DB, size int, dirtyOnly bool, fn func([]userContext) error) error {
+	metricsRepo := repository.NewPostgresMetricsRepository(db)
+	attrRepo := repository.NewPostgresAttributeRepository(db)
+	now := time.Now()
+
+	after := ""
+	for {
+		listPage := metricsRepo.ListPage
+		if dirtyOnly {
+			listPage = metricsRepo.ListDirtyPage
+		}
+		page, err := listPage(ctx, after, size)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		ids := make([]string, len(page))
+		for i, m := range page {
+			ids[i] = m.UserID
+		}
+		attrs, err := attrRepo.ListForUsers(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		users := make([]userContext, len(page))
+		for i, m := range page {
+			users[i] = userContext{userID: m.UserID, version: m.DataVersion, data: ruleengine.BuildContext(m, attrs[m.UserID], now)}
+		}
+		if err := fn(users); err != nil {
+			return err
+		}
+		if len(page) < size {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+
+	"daffodil-experimentation-platform/internal/bucketing"
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// Assignment is an experiment a user is enrolled in, with the variant they
+// were bucketed into.
+type Assignment struct {
+	Experiment domain.Experiment
+	Variant    domain.Variant
+}
+
+// AssignVariants buckets the user into every experiment of their matched
+// segments. Experiments whose weights leave the user's bucket uncovered are
+// dropped, so the user gets none of that experiment's features.
+func AssignVariants(userID string, experiments []domain.Experiment) []Assignment {
+	assignments := make([]Assignment, 0, len(experiments))
+	for _, e := range experiments {
+		v, ok := bucketing.Assign(userID, e)
+		if !ok {
+			continue
+		}
+		assignments = append(assignments, Assignment{Experiment: e, Variant: v})
+	}
+	return assignments
+}
+
+// FeatureSource identifies the experiment (and segment) that supplied a value
+type FeatureSource struct {
+	SegmentID     string `json:"segment_id"`
+	SegmentName   string `json:"segment_name"`
+	ExperimentID  string `json:"experiment_id"`
+	ExperimentKey string `json:"experiment_key"`
+	Variant       string `json:"variant"`
+	Priority      int    `json:"priority"`
+}
+
+// FeatureExplanation records how the final value of a feature key was chosen.
+// Winner is the highest priority source; Contributors lists every source that
+// ended up in the value, which is more than one only for merge strategies.
+type FeatureExplanation struct {
+	Strategy     domain.MergeStrategy `json:"strategy"`
+	Winner       FeatureSource        `json:"winner"`
+	Contributors []FeatureSource      `json:"contributors"`
+	Overridden   []FeatureSource      `json:"overridden,omitempty"`
+}
+
+// ResolveFeatures builds the feature map served to a user from the variants
+// they were assigned in the experiments of their matched segments.
+//
+// Experiments are applied from the highest priority down (ties go to the
+// oldest experiment), so the result does not depend on row order. Each key is
+// combined using its strategy from strategies, defaulting to highest priority
+// wins. Values whose type doesn't fit the strategy (e.g. a string under
+// deep_merge) are treated as overridden by the higher priority value.
+func ResolveFeatures(assignments []Assignment, strategies map[string]domain.MergeStrategy) (map[string]interface{}, map[string]*FeatureExplanation) {
+	ordered := make([]Assignment, len(assignments))
+	copy(ordered, assignments)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i].Experiment, ordered[j].Experiment
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+
+	features := make(map[string]interface{})
+	explanations := make(map[string]*FeatureExplanation)
+
+	for _, a := range ordered {
+		e := a.Experiment
+		var payload map[string]interface{}
+		if err := json.Unmarshal(a.Variant.Payload, &payload); err != nil {
+			log.Printf("Skipping experiment %s/%s: bad payload: %v", e.Key, a.Variant.Key, err)
+			continue
+		}
+
+		source := FeatureSource{
+			SegmentID:     e.SegmentID,
+			SegmentName:   e.SegmentName,
+			ExperimentID:  e.ID,
+			ExperimentKey: e.Key,
+			Variant:       a.Variant.Key,
+			Priority:      e.Priority,
+		}
+
+		for k, v := range payload {
+			current, taken := features[k]
+			if !taken {
+				strategy := strategies[k]
+				if !strategy.Valid() {
+					strategy = domain.MergeHighestPriority
+				}
+				features[k] = v
+				explanations[k] = &FeatureExplanation{
+					Strategy:     strategy,
+					Winner:       source,
+					Contributors: []FeatureSource{source},
+				}
+				continue
+			}
+
+			exp := explanations[k]
+			merged, ok := mergeValue(exp.Strategy, current, v)
+			if !ok {
+				exp.Overridden = append(exp.Overridden, source)
+				continue
+			}
+			features[k] = merged
+			exp.Contributors = append(exp.Contributors, source)
+		}
+	}
+
+	return features, explanations
+}
+
+// mergeValue combines a lower priority value into the current (higher
+// priority) one. It returns false when the lower value is simply overridden.
+func mergeValue(strategy domain.MergeStrategy, current, lower interface{}) (interface{}, bool) {
+	switch strategy {
+	case domain.MergeDeepMerge:
+		hi, ok1 := current.(map[string]interface{})
+		lo, ok2 := lower.(map[string]interface{})
+		if !ok1 || !ok2 {
+			return current, false
+		}
+		return deepMerge(hi, lo), true
+
+	case domain.MergeUnion:
+		hi, ok1 := current.([]interface{})
+		lo, ok2 := lower.([]interface{})
+		if !ok1 || !ok2 {
+			return current, false
+		}
+		return unionArrays(hi, lo), true
+	}
+	return current, false
+}
+
+// deepMerge returns a copy of hi with the keys of lo filled in wherever hi
+// doesn't set them. Nested objects are merged recursively.
+func deepMerge(hi, lo map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(hi)+len(lo))
+	for k, v := range lo {
+		out[k] = v
+	}
+	for k, v := range hi {
+		hiObj, ok1 := v.(map[string]interface{})
+		loObj, ok2 := out[k].(map[string]interface{})
+		if ok1 && ok2 {
+			out[k] = deepMerge(hiObj, loObj)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// unionArrays appends the elements of lo that aren't already in hi,
+// keeping the higher priority elements first.
+func unionArrays(hi, lo []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(hi)+len(lo))
+	seen := make(map[string]bool, len(hi)+len(lo))
+	for _, list := range [][]interface{}{hi, lo} {
+		for _, v := range list {
+			b, _ := json.Marshal(v)
+			if seen[string(b)] {
+				continue
+			}
+			seen[string(b)] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
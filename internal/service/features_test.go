@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+// assignment builds an assignment of a one-variant experiment; later
+// positions in a test are created later
+func assignment(key string, priority int, created int, payload string) Assignment {
+	return Assignment{
+		Experiment: domain.Experiment{
+			ID:        key,
+			Key:       key,
+			Priority:  priority,
+			CreatedAt: time.Unix(int64(created), 0),
+		},
+		Variant: domain.Variant{Key: "control", Payload: json.RawMessage(payload)},
+	}
+}
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestResolveFeatures(t *testing.T) {
+	tests := []struct {
+		name        string
+		strategy    domain.MergeStrategy
+		assignments []Assignment
+		want        string // the "f" feature as JSON
+		winner      string
+		contributed []string
+		overridden  []string
+	}{
+		{
+			name: "highest priority wins",
+			assignments: []Assignment{
+				assignment("low", 1, 0, `{"f": "low"}`),
+				assignment("high", 5, 1, `{"f": "high"}`),
+			},
+			want:        `"high"`,
+			winner:      "high",
+			contributed: []string{"high"},
+			overridden:  []string{"low"},
+		},
+		{
+			name: "ties go to the oldest experiment",
+			assignments: []Assignment{
+				assignment("newer", 3, 2, `{"f": 2}`),
+				assignment("older", 3, 1, `{"f": 1}`),
+			},
+			want:        `1`,
+			winner:      "older",
+			contributed: []string{"older"},
+			overridden:  []string{"newer"},
+		},
+		{
+			name:     "deep merge fills in nested keys",
+			strategy: domain.MergeDeepMerge,
+			assignments: []Assignment{
+				assignment("low", 1, 0, `{"f": {"a": 1, "b": {"x": 1, "y": 1}, "c": 1}}`),
+				assignment("high", 2, 1, `{"f": {"a": 2, "b": {"x": 2}}}`),
+			},
+			want:        `{"a": 2, "b": {"x": 2, "y": 1}, "c": 1}`,
+			winner:      "high",
+			contributed: []string{"high", "low"},
+		},
+		{
+			name:     "deep merge overrides values that are not objects",
+			strategy: domain.MergeDeepMerge,
+			assignments: []Assignment{
+				assignment("low", 1, 0, `{"f": "text"}`),
+				assignment("high", 2, 1, `{"f": {"a": 1}}`),
+			},
+			want:        `{"a": 1}`,
+			winner:      "high",
+			contributed: []string{"high"},
+			overridden:  []string{"low"},
+		},
+		{
+			name:     "union keeps higher priority elements first without duplicates",
+			strategy: domain.MergeUnion,
+			assignments: []Assignment{
+				assignment("low", 1, 0, `{"f": ["b", "c", {"id": 1}]}`),
+				assignment("mid", 2, 1, `{"f": [{"id": 1}, "d"]}`),
+				assignment("high", 3, 2, `{"f": ["a", "b"]}`),
+			},
+			want:        `["a", "b", {"id": 1}, "d", "c"]`,
+			winner:      "high",
+			contributed: []string{"high", "mid", "low"},
+		},
+		{
+			name:     "union overrides values that are not arrays",
+			strategy: domain.MergeUnion,
+			assignments: []Assignment{
+				assignment("low", 1, 0, `{"f": ["a"]}`),
+				assignment("high", 2, 1, `{"f": 7}`),
+			},
+			want:        `7`,
+			winner:      "high",
+			contributed: []string{"high"},
+			overridden:  []string{"low"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategies := map[string]domain.MergeStrategy{}
+			if tt.strategy != "" {
+				strategies["f"] = tt.strategy
+			}
+			features, explanations := ResolveFeatures(tt.assignments, strategies)
+
+			if got, want := features["f"], decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("f = %v, want %v", got, want)
+			}
+			exp := explanations["f"]
+			if exp.Winner.ExperimentKey != tt.winner {
+				t.Errorf("winner = %s, want %s", exp.Winner.ExperimentKey, tt.winner)
+			}
+			if got := sourceKeys(exp.Contributors); !reflect.DeepEqual(got, tt.contributed) {
+				t.Errorf("contributors = %v, want %v", got, tt.contributed)
+			}
+			if got := sourceKeys(exp.Overridden); !reflect.DeepEqual(got, tt.overridden) {
+				t.Errorf("overridden = %v, want %v", got, tt.overridden)
+			}
+		})
+	}
+}
+
+func TestResolveFeaturesDoesNotMutatePayloads(t *testing.T) {
+	low := assignment("low", 1, 0, `{"f": {"a": 1}}`)
+	high := assignment("high", 2, 1, `{"f": {"b": 2}}`)
+	strategies := map[string]domain.MergeStrategy{"f": domain.MergeDeepMerge}
+
+	first, _ := ResolveFeatures([]Assignment{low, high}, strategies)
+	second, _ := ResolveFeatures([]Assignment{high, low}, strategies)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("result depends on order: %v vs %v", first, second)
+	}
+	if string(low.Variant.Payload) != `{"f": {"a": 1}}` {
+		t.Errorf("payload changed to %s", low.Variant.Payload)
+	}
+}
+
+func sourceKeys(sources []FeatureSource) []string {
+	var keys []string
+	for _, s := range sources {
+		keys = append(keys, s.ExperimentKey)
+	}
+	return keys
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/repository"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MigrateMembershipKeys rewrites user:segments sets and user:segment_versions
+// hashes written before they were keyed by segment ID, replacing each
+// segment name with the ID of the oldest segment of that name. Names that
+// match no segment are dropped. Entries that are already IDs are kept, so
+// it is safe to run more than once. It returns how many users were
+// rewritten.
+//
+// It waits for and holds the evaluation lock as owner, so no evaluation
+// writes memberships while they are rewritten. A worker updating a user
+// meanwhile makes that user's rewrite start over from what the worker
+// wrote.
+func MigrateMembershipKeys(ctx context.Context, db *sql.DB, rdb *redis.Client, owner string) (int, error) {
+	lock, err := WaitEvaluationLock(ctx, rdb, owner)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	n, err := migrateMembershipKeys(lock.Context(), db, rdb)
+	if errors.Is(context.Cause(lock.Context()), jobs.ErrLockLost) {
+		return n, jobs.ErrLockLost
+	}
+	return n, err
+}
+
+func migrateMembershipKeys(ctx context.Context, db *sql.DB, rdb *redis.Client) (int, error) {
+	segments, err := repository.NewPostgresSegmentRepository(db).List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return rewriteMemberships(ctx, rdb, segments)
+}
+
+// rewriteMemberships rewrites every cached user's memberships from names to
+// the IDs of segments, which must be oldest first
+func rewriteMemberships(ctx context.Context, rdb *redis.Client, segments []domain.Segment) (int, error) {
+	ids := make(map[string]bool, len(segments))
+	byName := make(map[string]string, len(segments))
+	for _, s := range segments {
+		ids[s.ID] = true
+		// List is oldest first, and the oldest segment is the one that kept
+		// a shared name (scripts/unique_segment_names.sql)
+		if _, ok := byName[s.Name]; !ok {
+			byName[s.Name] = s.ID
+		}
+	}
+
+	// resolve maps a cached entry to a segment ID, or "" to drop it
+	resolve := func(member string) string {
+		if ids[member] {
+			return member
+		}
+		return byName[member]
+	}
+
+	rewritten := 0
+	iter := rdb.Scan(ctx, 0, "user:segments:*", 500).Iterator()
+	for iter.Next(ctx) {
+		userID := strings.TrimPrefix(iter.Val(), "user:segments:")
+		changed, err := migrateUser(ctx, rdb, userID, resolve)
+		if err != nil {
+			return rewritten, err
+		}
+		if changed {
+			rewritten++
+		}
+	}
+	return rewritten, iter.Err()
+}
+
+// migrateUser rewrites one user's memberships through resolve, watching
+// them so a concurrent write by the worker is not overwritten with what it
+// replaced. It reports whether anything had to be rewritten.
+func migrateUser(ctx context.Context, rdb *redis.Client, userID string, resolve func(string) string) (bool, error) {
+	key := "user:segments:" + userID
+	versionsKey := "user:segment_versions:" + userID
+
+	for {
+		changed := false
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			members, err := tx.SMembers(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			versions, err := tx.HGetAll(ctx, versionsKey).Result()
+			if err != nil {
+				return err
+			}
+
+			var newMembers []string
+			for _, m := range members {
+				id := resolve(m)
+				changed = changed || id != m
+				if id != "" {
+					newMembers = append(newMembers, id)
+				}
+			}
+			newVersions := make(map[string]interface{}, len(versions))
+			for field, v := range versions {
+				id := resolve(field)
+				changed = changed || id != field
+				if id != "" {
+					newVersions[id] = v
+				}
+			}
+			if !changed {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key, versionsKey)
+				if len(newMembers) > 0 {
+					pipe.SAdd(ctx, key, newMembers)
+				}
+				if len(newVersions) > 0 {
+					pipe.HSet(ctx, versionsKey, newVersions)
+				}
+				return nil
+			})
+			if err == nil {
+				log.Printf("🔁 Rewrote cached segments of %s: %v -> %v", userID, members, newMembers)
+			}
+			return err
+		}, key, versionsKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return changed, err
+		}
+	}
+}
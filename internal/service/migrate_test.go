@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"daffodil-experimentation-platform/internal/domain"
+)
+
+func TestRewriteMemberships(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	// Oldest first: the second "vip" lost the name to the first
+	segments := []domain.Segment{
+		{ID: "id-vip", Name: "vip"},
+		{ID: "id-big", Name: "big"},
+		{ID: "id-vip2", Name: "vip"},
+	}
+
+	// U1 is keyed by name, with one name that no segment has any more; U2
+	// is already keyed by ID; U3 mixes the two
+	m.SAdd("user:segments:U1", "vip", "big", "gone")
+	m.HSet("user:segment_versions:U1", "vip", "3")
+	m.HSet("user:segment_versions:U1", "gone", "1")
+	m.SAdd("user:segments:U2", "id-vip2", "id-big")
+	m.HSet("user:segment_versions:U2", "id-vip2", "2")
+	m.SAdd("user:segments:U3", "id-big", "vip")
+	m.SAdd("user:segments:U4", "gone")
+
+	check := func() {
+		t.Helper()
+		for user, want := range map[string][]string{
+			"U1": {"id-big", "id-vip"},
+			"U2": {"id-big", "id-vip2"},
+			"U3": {"id-big", "id-vip"},
+			"U4": nil,
+		} {
+			if got := members(t, m, "user:segments:"+user); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s segments = %v, want %v", user, got, want)
+			}
+		}
+		for user, want := range map[string]map[string]string{
+			"U1": {"id-vip": "3"},
+			"U2": {"id-vip2": "2"},
+		} {
+			got, _ := rdb.HGetAll(ctx, "user:segment_versions:"+user).Result()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s versions = %v, want %v", user, got, want)
+			}
+		}
+	}
+
+	n, err := rewriteMemberships(ctx, rdb, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("rewrote %d users, want 3", n)
+	}
+	check()
+
+	// A second run finds nothing left to rewrite
+	n, err = rewriteMemberships(ctx, rdb, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("second run rewrote %d users, want 0", n)
+	}
+	check()
+}
@@ -1,156 +1,289 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
-	"strings"
+	"slices"
+	"strconv"
+	"time"
+
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
 
-	"github.com/diegoholiveira/jsonlogic/v3"
 	"github.com/redis/go-redis/v9"
 )
 
-// Segment represents the structure in our database
-type Segment struct {
-	Name      string          `json:"name"`
-	RuleLogic json.RawMessage `json:"rule_logic"`
-	Payload   json.RawMessage `json:"payload"`
-}
+// ruleCache keeps compiled rules between hot-path evaluations in the worker
+var ruleCache = ruleengine.NewCache()
 
-// RunEvaluation pulls data from DB, runs rules, and updates Redis
-func RunEvaluation(ctx context.Context, db *sql.DB, rdb *redis.Client) error {
-	// 1. Get Segments
-	segRows, _ := db.Query("SELECT name, rule_logic FROM segments")
-	type segment struct {
-		Name string
-		Rule json.RawMessage
-	}
-	var segments []segment
-	for segRows.Next() {
-		var s segment
-		segRows.Scan(&s.Name, &s.Rule)
-		segments = append(segments, s)
-	}
-
-	// 2. Get Users
-	userRows, _ := db.Query("SELECT user_id, orders_23d FROM user_metrics")
-	for userRows.Next() {
-		var uID string
-		var oCount int
-		userRows.Scan(&uID, &oCount)
-
-		userData, _ := json.Marshal(map[string]int{"orders_23d": oCount})
-		var matchedSegments []string
-
-		for _, seg := range segments {
-			var result bytes.Buffer
-			jsonlogic.Apply(bytes.NewReader(seg.Rule), bytes.NewReader(userData), &result)
-			if strings.TrimSpace(result.String()) == "true" {
-				matchedSegments = append(matchedSegments, seg.Name)
-			}
-		}
+// LoadRules compiles the rule of every active segment inside its scheduled
+// window and puts them in dependency order. Segments whose rules do not
+// compile, or that reference each other in a cycle, are logged and left out.
+func LoadRules(ctx context.Context, db *sql.DB) ([]ruleengine.NamedRule, error) {
+	active, err := repository.NewPostgresSegmentRepository(db).ListActive(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		// 3. Update Redis
-		redisKey := "user:segments:" + uID
-		rdb.Del(ctx, redisKey)
-		if len(matchedSegments) > 0 {
-			rdb.SAdd(ctx, redisKey, matchedSegments)
+	var rules []ruleengine.NamedRule
+	for _, s := range active {
+		rule, err := ruleCache.Get(s.ID, s.RuleLogic)
+		if err != nil {
+			log.Printf("Skipping segment %s: %v", s.Name, err)
+			continue
 		}
+		rules = append(rules, ruleengine.NamedRule{ID: s.ID, Name: s.Name, Version: s.Version, Rule: rule})
 	}
-	return nil
+
+	ordered, cyclic := ruleengine.Order(rules)
+	for _, r := range cyclic {
+		log.Printf("Skipping segment %s: its in_segment references form a cycle", r.Name)
+	}
+	return ordered, nil
 }
 
-func EvaluateSpecificUser(ctx context.Context, db *sql.DB, rdb *redis.Client, uID string) error {
-	// 1. Fetch current metrics and location for THIS user
-	var oCount int
-	var totalSpend float64
-	var location string
+// segmentIDs lists the IDs of the matched segments. The user:segments sets
+// hold IDs rather than names so renaming a segment keeps its members.
+func segmentIDs(matched []ruleengine.NamedRule) []string {
+	ids := make([]string, len(matched))
+	for i, seg := range matched {
+		ids[i] = seg.ID
+	}
+	return ids
+}
 
-	err := db.QueryRow(`
-		SELECT orders_23d, total_spend, location_tag 
-		FROM user_metrics 
-		WHERE user_id = $1`, uID).Scan(&oCount, &totalSpend, &location)
+// segmentVersions maps each matched segment ID to the version of the
+// segment it was evaluated at, for the user:segment_versions hash
+func segmentVersions(matched []ruleengine.NamedRule) map[string]interface{} {
+	versions := make(map[string]interface{}, len(matched))
+	for _, seg := range matched {
+		versions[seg.ID] = seg.Version
+	}
+	return versions
+}
 
+// SegmentMemberships evaluates every segment for one user's context and
+// returns the names of the segments they are in, for rules that use
+// in_segment outside a full evaluation
+func SegmentMemberships(ctx context.Context, db *sql.DB, data map[string]interface{}) (map[string]bool, error) {
+	segments, err := LoadRules(ctx, db)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("User %s not found in metrics, skipping evaluation", uID)
-			return nil
-		}
-		return err
+		return nil, err
 	}
+	_, memberships := ruleengine.MatchAll(segments, data)
+	return memberships, nil
+}
 
-	// Prepare data for JsonLogic evaluation
-	userData := map[string]interface{}{
-		"orders_23d":   oCount,
-		"total_spend":  totalSpend,
-		"location_tag": location,
-	}
-	userDataBytes, _ := json.Marshal(userData)
+// forEachUser calls fn with each user's rule context, a page at a time.
+// Every bulk evaluation goes through here or pageUsers so they all see
+// users the same way.
+func forEachUser(ctx context.Context, db *sql.DB, fn func(userID string, data map[string]interface{})) error {
+	return pageUsers(ctx, db, DefaultBatchSize, false, func(page []userContext) error {
+		for _, u := range page {
+			fn(u.userID, u.data)
+		}
+		return nil
+	})
+}
 
-	// 2. Fetch all defined segments
-	rows, err := db.Query("SELECT name, rule_logic, payload FROM segments")
-	if err != nil {
-		return err
+// writeUser queues the commands that replace a user's cached segments,
+// segment versions, payload and payload sources
+func writeUser(ctx context.Context, pipe redis.Pipeliner, uID string, matched []ruleengine.NamedRule, payload map[string]interface{}, sources map[string]*FeatureExplanation) {
+	redisKeySegments := "user:segments:" + uID
+	redisKeyPayload := "user:payload:" + uID
+	redisKeySources := "user:payload_sources:" + uID
+	redisKeyVersions := "user:segment_versions:" + uID
+
+	// Clear old state
+	pipe.Del(ctx, redisKeySegments, redisKeyPayload, redisKeySources, redisKeyVersions)
+	if len(matched) == 0 {
+		return
 	}
-	defer rows.Close()
 
-	var matchedSegments []string
-	var mergedPayloads = make(map[string]interface{})
+	// Store segment IDs for quick lookup
+	pipe.SAdd(ctx, redisKeySegments, segmentIDs(matched))
 
-	for rows.Next() {
-		var s Segment
-		if err := rows.Scan(&s.Name, &s.RuleLogic, &s.Payload); err != nil {
-			continue
-		}
+	// And the version of each segment that produced the match
+	pipe.HSet(ctx, redisKeyVersions, segmentVersions(matched))
 
-		// Run JsonLogic evaluation
-		var result bytes.Buffer
-		err := jsonlogic.Apply(bytes.NewReader(s.RuleLogic), bytes.NewReader(userDataBytes), &result)
+	writePayload(ctx, pipe, uID, payload, sources)
+}
+
+// dataVersionKey holds the user_metrics data_version a user's cached
+// segments and payload were evaluated from
+func dataVersionKey(uID string) string {
+	return "user:data_version:" + uID
+}
+
+// writeRetries is how often writeUsers starts over when a user's cached
+// data version changes under it
+const writeRetries = 3
+
+// writeUsers writes the caches of users evaluated from their data at
+// userContext.version, queueing each user's commands with write, in one
+// transaction. The worker and the bulk evaluations write users without
+// holding a common lock, so users whose caches were already written from
+// newer data are left alone and returned as stale: overwriting them would
+// bring back what that data replaced. The data version keys are watched,
+// so a newer write landing meanwhile makes the transaction start over.
+//
+// It returns the users written, with the data version they were evaluated
+// at, and those that failed, with the first error.
+func writeUsers(ctx context.Context, rdb *redis.Client, users []userContext, write func(pipe redis.Pipeliner, u userContext)) (done map[string]int64, failed, stale []string, err error) {
+	keys := make([]string, len(users))
+	for i, u := range users {
+		keys[i] = dataVersionKey(u.userID)
+	}
+
+	var current []userContext
+	var cmds []redis.Cmder
+	// Where each current user's commands start in cmds
+	var starts []int
+	txn := func(tx *redis.Tx) error {
+		cached, err := tx.MGet(ctx, keys...).Result()
 		if err != nil {
-			log.Printf("Error evaluating rule for %s: %v", s.Name, err)
-			continue
+			return err
+		}
+		for i, u := range users {
+			if v, ok := cached[i].(string); ok {
+				if n, _ := strconv.ParseInt(v, 10, 64); n > u.version {
+					stale = append(stale, u.userID)
+					continue
+				}
+			}
+			current = append(current, u)
+		}
+		if len(current) == 0 {
+			return nil
 		}
 
-		// If rule matches (returns "true")
-		if strings.TrimSpace(result.String()) == "true" {
-			matchedSegments = append(matchedSegments, s.Name)
+		cmds, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, u := range current {
+				starts = append(starts, pipe.Len())
+				pipe.Set(ctx, dataVersionKey(u.userID), u.version, 0)
+				write(pipe, u)
+			}
+			starts = append(starts, pipe.Len())
+			return nil
+		})
+		return err
+	}
+	for i := 0; i <= writeRetries; i++ {
+		current, cmds, starts, stale = nil, nil, nil, nil
+		if err = rdb.Watch(ctx, txn, keys...); !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
 
-			// Merge the segment's payload into the final experiment config
-			var p map[string]interface{}
-			if err := json.Unmarshal(s.Payload, &p); err == nil {
-				for k, v := range p {
-					mergedPayloads[k] = v
-				}
+	done = make(map[string]int64, len(current))
+	if err != nil && (cmds == nil || errors.Is(err, redis.TxFailedErr)) {
+		// Nothing was written. If reading the versions failed the users
+		// were not even sorted out, so none of them count as stale.
+		for _, u := range users {
+			if !slices.Contains(stale, u.userID) {
+				failed = append(failed, u.userID)
 			}
 		}
+		return done, failed, stale, err
+	}
+	if cmds == nil {
+		return done, nil, stale, nil
 	}
 
-	// 3. Update Redis atomicly
-	redisKeySegments := "user:segments:" + uID
-	redisKeyPayload := "user:payload:" + uID
+	// A failed transaction marks every command failed, so checking each
+	// user's commands covers both that and errors from single commands
+	for i, u := range current {
+		ok := true
+		for _, cmd := range cmds[starts[i]:starts[i+1]] {
+			if cmd.Err() != nil && !errors.Is(cmd.Err(), redis.Nil) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			done[u.userID] = u.version
+		} else {
+			failed = append(failed, u.userID)
+		}
+	}
+	return done, failed, stale, err
+}
 
-	pipe := rdb.Pipeline()
+// writePayload queues the commands that store a user's merged payload
+func writePayload(ctx context.Context, pipe redis.Pipeliner, uID string, payload map[string]interface{}, sources map[string]*FeatureExplanation) {
+	// Store the merged JSON payload (the Banners, Tiles, etc.)
+	payloadBytes, _ := json.Marshal(payload)
+	pipe.Set(ctx, "user:payload:"+uID, payloadBytes, 0)
 
-	// Clear old state
-	pipe.Del(ctx, redisKeySegments, redisKeyPayload)
+	// And which segment supplied each value, for debugging conflicts
+	sourceBytes, _ := json.Marshal(sources)
+	pipe.Set(ctx, "user:payload_sources:"+uID, sourceBytes, 0)
+}
 
-	if len(matchedSegments) > 0 {
-		// Store segment names for quick lookup
-		pipe.SAdd(ctx, redisKeySegments, matchedSegments)
+func EvaluateSpecificUser(ctx context.Context, db *sql.DB, rdb *redis.Client, uID string) error {
+	metricsRepo := repository.NewPostgresMetricsRepository(db)
 
-		// Store the merged JSON payload (the Banners, Tiles, etc.)
-		payloadBytes, _ := json.Marshal(mergedPayloads)
-		pipe.Set(ctx, redisKeyPayload, payloadBytes, 0)
+	// 1. Fetch current metrics and location for THIS user
+	m, err := metricsRepo.GetMetrics(ctx, uID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("User %s not found in metrics, skipping evaluation", uID)
+			return nil
+		}
+		return err
+	}
+
+	attrs, err := repository.NewPostgresAttributeRepository(db).List(ctx, uID)
+	if err != nil {
+		return err
+	}
+
+	// Prepare data for JsonLogic evaluation
+	userData := ruleengine.BuildContext(*m, attrs, time.Now())
+
+	// 2. Evaluate all live segments, dependencies first
+	segments, err := LoadRules(ctx, db)
+	if err != nil {
+		return err
 	}
+	matched, _ := ruleengine.MatchAll(segments, userData)
+	matchedIDs := segmentIDs(matched)
 
-	_, err = pipe.Exec(ctx)
+	// Resolve the experiment payloads of every matched segment by priority
+	experiments, err := repository.NewPostgresExperimentRepository(db).ListForSegmentIDs(ctx, matchedIDs)
+	if err != nil {
+		return err
+	}
+	strategies, err := repository.NewPostgresFeatureStrategyRepository(db).List(ctx)
+	if err != nil {
+		return err
+	}
+	mergedPayloads, sources := ResolveFeatures(AssignVariants(uID, experiments), strategies)
+
+	// 3. Update Redis atomically, unless a bulk evaluation or another
+	// worker already cached the result of newer data
+	user := userContext{userID: uID, version: m.DataVersion, data: userData}
+	_, _, stale, err := writeUsers(ctx, rdb, []userContext{user}, func(pipe redis.Pipeliner, u userContext) {
+		writeUser(ctx, pipe, uID, matched, mergedPayloads, sources)
+	})
 	if err != nil {
 		log.Printf("Failed to update Redis for user %s: %v", uID, err)
 		return err
 	}
+	if len(stale) > 0 {
+		log.Printf("⏭️ Skipped %s: their cache already holds newer data", uID)
+		return nil
+	}
+
+	// The scheduled evaluation can skip them now, unless their data changed
+	// again since it was read
+	if err := metricsRepo.ClearDirty(ctx, map[string]int64{uID: m.DataVersion}); err != nil {
+		return err
+	}
 
-	log.Printf("✅ Re-evaluated %s: %d segments matched", uID, len(matchedSegments))
+	log.Printf("✅ Re-evaluated %s: %d segments matched", uID, len(matchedIDs))
 	return nil
 }
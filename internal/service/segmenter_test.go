@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedis starts an in-memory Redis for one test
+func testRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return m, rdb
+}
+
+// members returns a Redis set sorted, or nil if it does not exist
+func members(t *testing.T, m *miniredis.Miniredis, key string) []string {
+	t.Helper()
+	if !m.Exists(key) {
+		return nil
+	}
+	got, err := m.Members(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	return got
+}
+
+// markAs queues a user's segments set as holding just tag
+func markAs(ctx context.Context, tag string) func(redis.Pipeliner, userContext) {
+	return func(pipe redis.Pipeliner, u userContext) {
+		pipe.Del(ctx, "user:segments:"+u.userID)
+		pipe.SAdd(ctx, "user:segments:"+u.userID, tag)
+	}
+}
+
+func TestWriteUsers(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	// U2 was cached from newer data than this write read, U3 from the same
+	m.Set(dataVersionKey("U2"), "5")
+	m.SAdd("user:segments:U2", "fresh")
+	m.Set(dataVersionKey("U3"), "3")
+
+	users := []userContext{{userID: "U1", version: 1}, {userID: "U2", version: 4}, {userID: "U3", version: 3}}
+	done, failed, stale, err := writeUsers(ctx, rdb, users, markAs(ctx, "bulk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"U1": 1, "U3": 3}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done = %v, want %v", done, want)
+	}
+	if len(failed) != 0 {
+		t.Errorf("failed = %v, want none", failed)
+	}
+	if want := []string{"U2"}; !reflect.DeepEqual(stale, want) {
+		t.Errorf("stale = %v, want %v", stale, want)
+	}
+
+	for _, tt := range []struct {
+		user, version string
+		segments      []string
+	}{
+		{"U1", "1", []string{"bulk"}},
+		{"U2", "5", []string{"fresh"}},
+		{"U3", "3", []string{"bulk"}},
+	} {
+		if got, _ := m.Get(dataVersionKey(tt.user)); got != tt.version {
+			t.Errorf("%s data version = %q, want %q", tt.user, got, tt.version)
+		}
+		if got := members(t, m, "user:segments:"+tt.user); !reflect.DeepEqual(got, tt.segments) {
+			t.Errorf("%s segments = %v, want %v", tt.user, got, tt.segments)
+		}
+	}
+}
+
+func TestWriteUsersLosesToConcurrentNewerWrite(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	// The worker caches newer data while the bulk write is being queued;
+	// the watched version key makes the bulk write start over and skip U1
+	raced := false
+	done, _, stale, err := writeUsers(ctx, rdb, []userContext{{userID: "U1", version: 1}, {userID: "U2", version: 1}},
+		func(pipe redis.Pipeliner, u userContext) {
+			if !raced {
+				raced = true
+				_, _, _, err := writeUsers(ctx, rdb, []userContext{{userID: "U1", version: 2}}, markAs(ctx, "worker"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			markAs(ctx, "bulk")(pipe, u)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"U2": 1}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done = %v, want %v", done, want)
+	}
+	if want := []string{"U1"}; !reflect.DeepEqual(stale, want) {
+		t.Errorf("stale = %v, want %v", stale, want)
+	}
+	if got := members(t, m, "user:segments:U1"); !reflect.DeepEqual(got, []string{"worker"}) {
+		t.Errorf("U1 segments = %v, want the worker's", got)
+	}
+}
+
+func TestWriteUsersFailure(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+	m.SetError("unavailable")
+
+	done, failed, stale, err := writeUsers(ctx, rdb, []userContext{{userID: "U1"}, {userID: "U2"}}, markAs(ctx, "bulk"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(done) != 0 || len(stale) != 0 {
+		t.Errorf("done = %v, stale = %v, want none", done, stale)
+	}
+	if want := []string{"U1", "U2"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed = %v, want %v", failed, want)
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"daffodil-experimentation-platform/internal/jobs"
+	"daffodil-experimentation-platform/internal/repository"
+	"daffodil-experimentation-platform/internal/ruleengine"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SegmentJobKind is the jobs.Job kind of EvaluateSegment
+const SegmentJobKind = "segment_evaluation"
+
+// EvaluateSegment re-evaluates one segment for every user after it was
+// created, changed, deactivated or deleted, together with the segments
+// whose rules reference it with in_segment. Only those segment IDs are
+// added to or removed from each user's cached memberships; a segment that
+// is no longer live is removed from everyone. Users whose memberships
+// change get their payload rebuilt. Progress is reported through t in
+// users, with "added" and "removed" counts. Callers hold the lock from
+// WaitEvaluationLock, so it never overlaps Evaluate or another segment job.
+func EvaluateSegment(ctx context.Context, db *sql.DB, rdb *redis.Client, segmentID string, t *jobs.Tracker) error {
+	segments, err := LoadRules(ctx, db)
+	if err != nil {
+		return err
+	}
+	payloads, err := loadPayloadSource(ctx, db, segments)
+	if err != nil {
+		return err
+	}
+
+	// The segment's name is what other rules reference
+	var name string
+	s, err := repository.NewPostgresSegmentRepository(db).Get(ctx, segmentID)
+	switch {
+	case err == nil:
+		name = s.Name
+	case !errors.Is(err, repository.ErrNotFound):
+		return err
+	}
+	targets := dependents(segments, segmentID, name)
+
+	metrics := repository.NewPostgresMetricsRepository(db)
+	total, err := metrics.Count(ctx, false)
+	if err != nil {
+		return err
+	}
+	t.SetTotal(total)
+
+	return pageUsers(ctx, db, DefaultBatchSize, false, func(page []userContext) error {
+		added, removed, failed := updateMemberships(ctx, rdb, segments, payloads, targets, page)
+		// The scheduled evaluation retries users that could not be updated
+		if err := metrics.MarkDirty(ctx, failed); err != nil {
+			return err
+		}
+		t.Progress(int64(len(page)), int64(len(failed)), map[string]int64{"added": added, "removed": removed})
+		return ctx.Err()
+	})
+}
+
+// dependents returns the IDs of the segment and of every live segment that
+// references it with in_segment, directly or through other segments
+func dependents(segments []ruleengine.NamedRule, segmentID, name string) map[string]bool {
+	targets := map[string]bool{segmentID: true}
+	if name == "" {
+		return targets
+	}
+	names := map[string]bool{name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range segments {
+			if targets[s.ID] {
+				continue
+			}
+			for _, dep := range s.Rule.Dependencies() {
+				if names[dep] {
+					targets[s.ID], names[s.Name], changed = true, true, true
+					break
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// updateMemberships evaluates a page of users and adds or removes the
+// target segments in their cached memberships, then rebuilds the payloads
+// of the users whose memberships changed. Users the worker already
+// re-evaluated from newer data are left as they are. It returns how many
+// memberships were added and removed, and the users that could not be
+// updated.
+func updateMemberships(ctx context.Context, rdb *redis.Client, segments []ruleengine.NamedRule, payloads *payloadSource, targets map[string]bool, page []userContext) (added, removed int64, failed []string) {
+	versions := make(map[string]int, len(segments))
+	for _, s := range segments {
+		versions[s.ID] = s.Version
+	}
+	in := make(map[string]map[string]bool, len(page))
+	for _, u := range page {
+		matched, _ := ruleengine.MatchAll(segments, u.data)
+		in[u.userID] = make(map[string]bool, len(matched))
+		for _, s := range matched {
+			in[u.userID][s.ID] = true
+		}
+	}
+
+	type change struct {
+		cmd   *redis.IntCmd
+		added bool
+	}
+	changes := make(map[string][]change, len(page))
+
+	done, failed, _, _ := writeUsers(ctx, rdb, page, func(pipe redis.Pipeliner, u userContext) {
+		key := "user:segments:" + u.userID
+		versionsKey := "user:segment_versions:" + u.userID
+		changes[u.userID] = nil
+		for id := range targets {
+			if in[u.userID][id] {
+				changes[u.userID] = append(changes[u.userID], change{cmd: pipe.SAdd(ctx, key, id), added: true})
+				pipe.HSet(ctx, versionsKey, id, versions[id])
+			} else {
+				changes[u.userID] = append(changes[u.userID], change{cmd: pipe.SRem(ctx, key, id)})
+				pipe.HDel(ctx, versionsKey, id)
+			}
+		}
+	})
+
+	// Rebuild the payloads of the users whose memberships changed, from
+	// what their cached memberships now hold
+	var changedUsers []string
+	for _, u := range page {
+		if _, ok := done[u.userID]; !ok {
+			continue
+		}
+		userChanged := false
+		for _, c := range changes[u.userID] {
+			if c.cmd.Val() == 0 {
+				continue
+			}
+			userChanged = true
+			if c.added {
+				added++
+			} else {
+				removed++
+			}
+		}
+		if userChanged {
+			changedUsers = append(changedUsers, u.userID)
+		}
+	}
+
+	for _, userID := range changedUsers {
+		if err := rebuildPayload(ctx, rdb, payloads, userID); err != nil {
+			failed = append(failed, userID)
+		}
+	}
+	return added, removed, failed
+}
+
+// payloadRetries is how often rebuildPayload retries when the user's
+// memberships change under it
+const payloadRetries = 3
+
+// rebuildPayload rewrites a user's payload from their cached memberships.
+// The memberships are watched, so a worker rewriting them meanwhile makes
+// the write fail and be retried rather than leave a payload that belongs
+// to neither.
+func rebuildPayload(ctx context.Context, rdb *redis.Client, payloads *payloadSource, userID string) error {
+	key := "user:segments:" + userID
+	rebuild := func(tx *redis.Tx) error {
+		ids, err := tx.SMembers(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(ids) == 0 {
+				pipe.Del(ctx, "user:payload:"+userID, "user:payload_sources:"+userID)
+				return nil
+			}
+			features, sources := payloads.resolve(userID, ids)
+			writePayload(ctx, pipe, userID, features, sources)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < payloadRetries; i++ {
+		if err = rdb.Watch(ctx, rebuild, key); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"daffodil-experimentation-platform/internal/domain"
+	"daffodil-experimentation-platform/internal/ruleengine"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// rules compiles segments given as name => DSL, in dependency order. Each
+// segment's ID is "s-" and its name.
+func rules(t *testing.T, pairs ...string) []ruleengine.NamedRule {
+	t.Helper()
+	var named []ruleengine.NamedRule
+	for i := 0; i < len(pairs); i += 2 {
+		raw, err := ruleengine.CompileDSL(pairs[i+1])
+		if err != nil {
+			t.Fatalf("%s: %v", pairs[i], err)
+		}
+		rule, err := ruleengine.Compile(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", pairs[i], err)
+		}
+		named = append(named, ruleengine.NamedRule{ID: "s-" + pairs[i], Name: pairs[i], Version: 2, Rule: rule})
+	}
+	ordered, _ := ruleengine.Order(named)
+	return ordered
+}
+
+// banners is a payload source with one experiment per segment, each setting
+// the "banner" feature to the segment's name
+func banners(segments []ruleengine.NamedRule) *payloadSource {
+	p := &payloadSource{experiments: map[string][]domain.Experiment{}}
+	for i, s := range segments {
+		p.experiments[s.ID] = []domain.Experiment{{
+			ID:        "e-" + s.Name,
+			Key:       s.Name,
+			SegmentID: s.ID,
+			Priority:  i,
+			Payload:   json.RawMessage(`{"banner": "` + s.Name + `"}`),
+		}}
+	}
+	return p
+}
+
+func payload(t *testing.T, m *miniredis.Miniredis, userID string) map[string]interface{} {
+	t.Helper()
+	raw, err := m.Get("user:payload:" + userID)
+	if err != nil {
+		return nil
+	}
+	var features map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &features); err != nil {
+		t.Fatal(err)
+	}
+	return features
+}
+
+func TestDependents(t *testing.T) {
+	segments := rules(t,
+		"vip", "ltv > 100",
+		"big", `in_segment("vip") and orders_23d > 1`,
+		"bigger", `in_segment("big") and orders_23d > 10`,
+		"other", "ltv > 0",
+		"not_vip", `not in_segment("vip")`,
+	)
+	tests := []struct {
+		name, id, segment string
+		want              []string
+	}{
+		{"direct and transitive dependents", "s-vip", "vip", []string{"s-big", "s-bigger", "s-not_vip", "s-vip"}},
+		{"leaf", "s-bigger", "bigger", []string{"s-bigger"}},
+		{"deleted segment", "s-gone", "", []string{"s-gone"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for id := range dependents(segments, tt.id, tt.segment) {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependents = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateMemberships(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	segments := rules(t,
+		"vip", "ltv > 100",
+		"big", `in_segment("vip") and orders_23d > 1`,
+		"other", "ltv > 0",
+	)
+	targets := dependents(segments, "s-vip", "vip")
+
+	// U1 joins vip and big; U2 leaves vip; U3 stays out; U4 was already
+	// cached by the worker from newer data
+	m.SAdd("user:segments:U1", "s-other")
+	m.SAdd("user:segments:U2", "s-vip", "s-other")
+	m.HSet("user:segment_versions:U2", "s-vip", "1")
+	m.SAdd("user:segments:U4", "s-other")
+	m.Set(dataVersionKey("U4"), "9")
+	page := []userContext{
+		{userID: "U1", version: 1, data: map[string]interface{}{"ltv": 500.0, "orders_23d": 5.0}},
+		{userID: "U2", version: 1, data: map[string]interface{}{"ltv": 10.0, "orders_23d": 5.0}},
+		{userID: "U3", version: 1, data: map[string]interface{}{"ltv": 10.0, "orders_23d": 0.0}},
+		{userID: "U4", version: 3, data: map[string]interface{}{"ltv": 500.0, "orders_23d": 5.0}},
+	}
+
+	added, removed, failed := updateMemberships(ctx, rdb, segments, banners(segments), targets, page)
+	if added != 2 || removed != 1 || len(failed) != 0 {
+		t.Errorf("added %d, removed %d, failed %v; want 2, 1, none", added, removed, failed)
+	}
+
+	// Only the target segments are touched; "other" is left to the
+	// scheduled evaluation
+	for user, want := range map[string][]string{
+		"U1": {"s-big", "s-other", "s-vip"},
+		"U2": {"s-other"},
+		"U3": nil,
+		"U4": {"s-other"},
+	} {
+		if got := members(t, m, "user:segments:"+user); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s segments = %v, want %v", user, got, want)
+		}
+	}
+	if got := m.HGet("user:segment_versions:U1", "s-big"); got != "2" {
+		t.Errorf("U1 version of big = %q, want 2", got)
+	}
+	if m.Exists("user:segment_versions:U2") {
+		t.Errorf("U2 keeps a version of vip after leaving it")
+	}
+
+	// Payloads are rebuilt from the whole set, for changed users only
+	if got := payload(t, m, "U1"); got["banner"] != "other" {
+		t.Errorf("U1 payload = %v, want the highest priority banner", got)
+	}
+	if got := payload(t, m, "U2"); got["banner"] != "other" {
+		t.Errorf("U2 payload = %v, want other's banner", got)
+	}
+	for _, user := range []string{"U3", "U4"} {
+		if m.Exists("user:payload:" + user) {
+			t.Errorf("%s payload was written", user)
+		}
+	}
+}
+
+func TestUpdateMembershipsRemovesDeletedSegment(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+
+	// The segment is gone, so nobody matches it and every cached
+	// membership goes; a user left with none loses their payload
+	m.SAdd("user:segments:U1", "s-gone")
+	m.Set("user:payload:U1", `{"banner": "gone"}`)
+	m.Set("user:payload_sources:U1", `{}`)
+	page := []userContext{{userID: "U1", data: map[string]interface{}{"ltv": 500.0}}}
+
+	_, removed, failed := updateMemberships(ctx, rdb, nil, banners(nil), dependents(nil, "s-gone", ""), page)
+	if removed != 1 || len(failed) != 0 {
+		t.Errorf("removed %d, failed %v; want 1, none", removed, failed)
+	}
+	for _, key := range []string{"user:segments:U1", "user:payload:U1", "user:payload_sources:U1"} {
+		if m.Exists(key) {
+			t.Errorf("%s still exists", key)
+		}
+	}
+}
+
+// raceHook lets the worker write a user's segments right after the first
+// time a payload rebuild reads them
+type raceHook struct {
+	key  string
+	race func()
+}
+
+func (h *raceHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *raceHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if h.race != nil && strings.EqualFold(cmd.Name(), "smembers") && cmd.Args()[1] == h.key {
+			race := h.race
+			h.race = nil
+			race()
+		}
+		return err
+	}
+}
+
+func (h *raceHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRebuildPayloadRetriesAfterConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+	m, rdb := testRedis(t)
+	segments := rules(t, "vip", "ltv > 100", "other", "ltv > 0")
+
+	m.SAdd("user:segments:U1", "s-vip")
+	reads := 0
+	hook := &raceHook{key: "user:segments:U1"}
+	hook.race = func() {
+		reads++
+		// The worker replaces the memberships between the read and the
+		// write, so the rebuild has to start over from its set
+		m.Del("user:segments:U1")
+		m.SAdd("user:segments:U1", "s-other")
+	}
+	rdb.AddHook(hook)
+
+	if err := rebuildPayload(ctx, rdb, banners(segments), "U1"); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 1 {
+		t.Fatalf("raced %d times, want 1", reads)
+	}
+	if got := payload(t, m, "U1"); got["banner"] != "other" {
+		t.Errorf("payload = %v, want one built from the worker's memberships", got)
+	}
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -16,6 +19,15 @@ type Config struct {
 	KafkaBroker string
 	KafkaTopic  string
 	APIPort     string
+
+	// Exposure logging
+	ExposureTopic       string
+	ExposureDedupWindow time.Duration
+	ExposureQueueSize   int // requests' worth of exposures buffered for publishing
+	ExposureWorkers     int
+
+	// Custom user attributes
+	AttributeTopic string
 }
 
 func LoadConfig() *Config {
@@ -32,6 +44,13 @@ func LoadConfig() *Config {
 		KafkaBroker: getEnv("KAFKA_BROKER", "localhost:9092"),
 		KafkaTopic:  getEnv("KAFKA_TOPIC", "order_events"),
 		APIPort:     getEnv("API_PORT", "8080"),
+
+		ExposureTopic:       getEnv("EXPOSURE_TOPIC", "experiment_exposures"),
+		ExposureDedupWindow: getDuration("EXPOSURE_DEDUP_WINDOW", time.Hour),
+		ExposureQueueSize:   getInt("EXPOSURE_QUEUE_SIZE", 10000),
+		ExposureWorkers:     getInt("EXPOSURE_WORKERS", 4),
+
+		AttributeTopic: getEnv("ATTRIBUTE_TOPIC", "user_attribute_events"),
 	}
 }
 
@@ -41,3 +60,29 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %v: %v", key, value, fallback, err)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,27 @@
+-- Backfill order_events for users whose orders_23d was counted before order
+-- events were stored. orders_23d is recounted from order_events, so without
+-- this the first decay run, or the user's next order, would reset their
+-- count to what the events show: nothing.
+--
+-- Each counted order becomes one zero-amount event marked backfilled, dated
+-- now, since the old counter kept no dates. Users keep their count and their
+-- segments today, and the seeded orders expire 23 days from now like real
+-- ones. Results analysis ignores backfilled events.
+--
+-- Safe to run more than once: users that already have events are skipped.
+--
+-- order_events must exist first: run scripts/init.sql (make migrate-schema,
+-- which make backfill-orders does before this).
+
+BEGIN;
+
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS backfilled BOOLEAN NOT NULL DEFAULT false;
+
+INSERT INTO order_events (user_id, amount, location_tag, created_at, backfilled)
+SELECT m.user_id, 0, m.location_tag, NOW(), true
+FROM user_metrics m
+CROSS JOIN LATERAL generate_series(1, m.orders_23d)
+WHERE m.orders_23d > 0
+  AND NOT EXISTS (SELECT 1 FROM order_events o WHERE o.user_id = m.user_id);
+
+COMMIT;
@@ -1,11 +1,31 @@
+-- The schema part of this file is safe to run again on an existing
+-- database (make migrate-schema): columns added since a table was first
+-- created are added with ALTER TABLE ... ADD COLUMN IF NOT EXISTS, and the
+-- demo data is only seeded into an empty database.
+
 -- 1. Segments Table (The "Rules")
 CREATE TABLE IF NOT EXISTS segments (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     name VARCHAR(255) NOT NULL,
     rule_logic JSONB NOT NULL,
     is_active BOOLEAN DEFAULT true,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    starts_at TIMESTAMP WITH TIME ZONE, -- NULL: no scheduled start
+    ends_at TIMESTAMP WITH TIME ZONE,   -- NULL: no scheduled end
+    version INTEGER NOT NULL DEFAULT 0, -- latest row in segment_versions
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK (ends_at IS NULL OR starts_at IS NULL OR ends_at > starts_at)
 );
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS starts_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS ends_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 0;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'segments_check') THEN
+        ALTER TABLE segments ADD CONSTRAINT segments_check CHECK (ends_at IS NULL OR starts_at IS NULL OR ends_at > starts_at);
+    END IF;
+END $$;
+-- in_segment references segments by name, so a name must point at one segment
+CREATE UNIQUE INDEX IF NOT EXISTS idx_segments_name ON segments (name);
 
 -- 2. User Metrics Table (The "State")
 CREATE TABLE IF NOT EXISTS user_metrics (
@@ -16,8 +36,14 @@ CREATE TABLE IF NOT EXISTS user_metrics (
     location_tag VARCHAR(100) DEFAULT 'unknown',
     total_spend DECIMAL(12, 2) DEFAULT 0.00,
     ltv DECIMAL(12, 2) DEFAULT 0.00,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    dirty_since TIMESTAMP WITH TIME ZONE, -- set when the user's data changes, cleared once they are re-evaluated
+    data_version BIGINT NOT NULL DEFAULT 0 -- bumped on every change, so an evaluation only clears dirty_since if nothing changed since it read the row
 );
+ALTER TABLE user_metrics ADD COLUMN IF NOT EXISTS dirty_since TIMESTAMP WITH TIME ZONE;
+ALTER TABLE user_metrics ADD COLUMN IF NOT EXISTS data_version BIGINT NOT NULL DEFAULT 0;
+-- Incremental evaluation pages through dirty users only
+CREATE INDEX IF NOT EXISTS idx_user_metrics_dirty ON user_metrics (user_id) WHERE dirty_since IS NOT NULL;
 
 -- 3. Experiments Table (The "Payload")
 CREATE TABLE IF NOT EXISTS experiments (
@@ -25,10 +51,146 @@ CREATE TABLE IF NOT EXISTS experiments (
     segment_id UUID REFERENCES segments(id),
     experiment_key VARCHAR(100) NOT NULL,
     variant_data JSONB NOT NULL,
+    variants JSONB NOT NULL DEFAULT '[]', -- [{"key": "control", "weight": 50, "payload": {...}}, ...]
+    salt VARCHAR(100) NOT NULL DEFAULT '',
     priority INTEGER DEFAULT 0,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    starts_at TIMESTAMP WITH TIME ZONE,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK (ends_at IS NULL OR starts_at IS NULL OR ends_at > starts_at)
+);
+ALTER TABLE experiments ADD COLUMN IF NOT EXISTS variants JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE experiments ADD COLUMN IF NOT EXISTS salt VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE experiments ADD COLUMN IF NOT EXISTS starts_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE experiments ADD COLUMN IF NOT EXISTS ends_at TIMESTAMP WITH TIME ZONE;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'experiments_check') THEN
+        ALTER TABLE experiments ADD CONSTRAINT experiments_check CHECK (ends_at IS NULL OR starts_at IS NULL OR ends_at > starts_at);
+    END IF;
+END $$;
+
+-- 4. Feature Strategies (how a feature key is merged when several segments set it)
+-- Keys without a row fall back to 'priority': the highest priority experiment wins.
+CREATE TABLE IF NOT EXISTS feature_strategies (
+    feature_key VARCHAR(100) PRIMARY KEY,
+    strategy VARCHAR(20) NOT NULL CHECK (strategy IN ('priority', 'deep_merge', 'union'))
+);
+
+-- 5. Order Events (every order the worker consumed, for results analysis)
+CREATE TABLE IF NOT EXISTS order_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    amount DECIMAL(12, 2) NOT NULL DEFAULT 0.00,
+    location_tag VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    backfilled BOOLEAN NOT NULL DEFAULT false -- seeded by scripts/backfill_order_events.sql, not a real order
+);
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS backfilled BOOLEAN NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS idx_order_events_user_time ON order_events (user_id, created_at);
+
+-- 6. Experiment Exposures (who was served which variant, from the exposure topic)
+CREATE TABLE IF NOT EXISTS experiment_exposures (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    experiment_id UUID NOT NULL,
+    experiment_key VARCHAR(100) NOT NULL,
+    variant VARCHAR(100) NOT NULL,
+    segment_id UUID,
+    exposed_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_exposures_experiment_user ON experiment_exposures (experiment_id, user_id);
+
+-- 7. User Attributes (typed custom properties for targeting, readable in rules as attr.<key>)
+CREATE TABLE IF NOT EXISTS user_attributes (
+    user_id VARCHAR(255) NOT NULL,
+    key VARCHAR(64) NOT NULL,
+    value_type VARCHAR(20) NOT NULL CHECK (value_type IN ('string', 'number', 'boolean', 'timestamp')),
+    value JSONB NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, key)
+);
+
+-- 8. Segment Versions (immutable history of every change to a segment and its experiments)
+-- No foreign key, so the history of a deleted segment survives and it can be restored.
+CREATE TABLE IF NOT EXISTS segment_versions (
+    segment_id UUID NOT NULL,
+    version INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    rule_logic JSONB NOT NULL,
+    is_active BOOLEAN NOT NULL,
+    starts_at TIMESTAMP WITH TIME ZONE,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    experiments JSONB NOT NULL DEFAULT '[]', -- snapshot of the segment's experiments
+    author VARCHAR(255) NOT NULL,
+    change VARCHAR(100) NOT NULL,
+    diff JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (segment_id, version)
 );
 
--- Seed a sample "Power User" segment for the demo
-INSERT INTO segments (name, rule_logic) VALUES 
-('Power User', '{"and": [{">": [{"var": "orders_23d"}, 25]}]}');
\ No newline at end of file
+CREATE OR REPLACE FUNCTION segment_versions_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'segment_versions is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS segment_versions_append_only ON segment_versions;
+CREATE TRIGGER segment_versions_append_only BEFORE UPDATE OR DELETE ON segment_versions
+    FOR EACH ROW EXECUTE FUNCTION segment_versions_append_only();
+
+-- 9. Audit Log (append-only record of every mutating API call)
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(255) NOT NULL, -- the route, e.g. 'PUT /segments/{id}'
+    resource_type VARCHAR(100) NOT NULL,
+    resource_id VARCHAR(255) NOT NULL DEFAULT '',
+    request_id VARCHAR(100) NOT NULL,
+    status INTEGER NOT NULL,
+    before JSONB,
+    after JSONB
+);
+CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log (resource_type, resource_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actor, id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- Seed a sample "Power User" segment, and the "Power User" treatment that
+-- used to be hardcoded in the API, for the demo
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM segments) THEN
+        INSERT INTO segments (name, rule_logic) VALUES
+        ('Power User', '{"and": [{">": [{"var": "orders_23d"}, 25]}]}');
+
+        INSERT INTO experiments (segment_id, experiment_key, variant_data, priority)
+        SELECT id, 'power_user_home', '{"show_pizza_tile": true, "home_banner": "Premium_Banner_V1", "discount_pct": 15}', 10
+        FROM segments WHERE name = 'Power User';
+    END IF;
+END $$;
+
+-- Version 1 of every segment without one: the seeded segments, and those
+-- created before segments were versioned
+INSERT INTO segment_versions (segment_id, version, name, rule_logic, is_active, starts_at, ends_at, experiments, author, change)
+SELECT s.id, 1, s.name, s.rule_logic, s.is_active, s.starts_at, s.ends_at,
+       COALESCE((SELECT jsonb_agg(jsonb_build_object(
+                    'id', e.id, 'segment_id', e.segment_id, 'segment_name', s.name,
+                    'key', e.experiment_key, 'payload', e.variant_data, 'variants', e.variants,
+                    'salt', e.salt, 'priority', e.priority, 'starts_at', e.starts_at, 'ends_at', e.ends_at,
+                    'created_at', e.created_at))
+                 FROM experiments e WHERE e.segment_id = s.id), '[]'),
+       'seed', 'created'
+FROM segments s
+WHERE s.version = 0
+ON CONFLICT (segment_id, version) DO NOTHING;
+UPDATE segments SET version = 1 WHERE version = 0;
@@ -0,0 +1,24 @@
+-- Make segment names unique on databases created before idx_segments_name.
+-- in_segment references segments by name, so two segments sharing a name
+-- made those references ambiguous.
+--
+-- The oldest segment keeps the name; later ones get their position appended,
+-- e.g. "VIP (2)". Rules that reference the name now mean the oldest segment
+-- only, so review them afterwards. The rename is not recorded in
+-- segment_versions; the next edit of a renamed segment will show it.
+--
+-- Safe to run more than once.
+
+BEGIN;
+
+UPDATE segments s
+SET name = s.name || ' (' || d.n || ')'
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY name ORDER BY created_at, id) AS n
+    FROM segments
+) d
+WHERE s.id = d.id AND d.n > 1;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_segments_name ON segments (name);
+
+COMMIT;